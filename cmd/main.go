@@ -1,41 +1,205 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"github.com/fsnotify/fsnotify"
+	"github.com/stefanaki/cpuset-plugin/pkg/cdi"
+	"github.com/stefanaki/cpuset-plugin/pkg/client"
+	"github.com/stefanaki/cpuset-plugin/pkg/config"
 	"github.com/stefanaki/cpuset-plugin/pkg/controller"
 	"github.com/stefanaki/cpuset-plugin/pkg/cpuset"
+	"github.com/stefanaki/cpuset-plugin/pkg/cpuview"
+	"github.com/stefanaki/cpuset-plugin/pkg/dra"
+	"github.com/stefanaki/cpuset-plugin/pkg/health"
 	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	cpusetutils "k8s.io/utils/cpuset"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
-	var nodeName *string = flag.String("node-name", "minikube", "Name of the node")
+	var nodeName *string = flag.String("node-name", "", "Name of the node (Default: the NODE_NAME environment variable)")
 	var containerRuntime = flag.String("container-runtime", "docker", "Container Runtime (Default: containerd, Values: containerd, docker, kind)")
 	var cgroupsPath = flag.String("cgroups-path", "/sys/fs/cgroup", "Path to cgroups")
 	var cgroupsDriver = flag.String("cgroups-driver", "systemd", "Set cgroups driver used by kubelet. Values: systemd, cgroupfs")
+	var cpuViews = flag.Bool("cpu-views", false, "Mount container-scoped copies of the CPU online, possible and cpuinfo files that list only the allocated CPUs")
+	var cpuViewsDir = flag.String("cpu-views-dir", "/var/lib/cpuset-device-plugin/cpu-views", "Host directory of the generated CPU view files")
+	var sysfsPath = flag.String("sysfs-path", "/sys", "Path to sysfs, used for CPU health checks")
+	var healthCheckInterval = flag.Duration("health-check-interval", 10*time.Second, "Interval between CPU health checks")
+	var unhealthyCPUs = flag.String("unhealthy-cpus", "", "CPUs marked unhealthy by the administrator, in cpuset list format (e.g. 2,4-5)")
+	var resourceDomain = flag.String("resource-domain", plugin.Vendor, "Domain under which the resources are registered")
+	var resources = flag.String("resources", "numa,socket,core,cpu", "Comma separated list of resources to register, each optionally followed by its socket file name (e.g. core=core.sock,cpu)")
+	var sharedCPUs = flag.String("shared-cpus", "", "CPUs advertised as non-exclusive cpu-shared devices, in cpuset list format (e.g. 8-11)")
+	var sharedCPUReplicas = flag.Int("shared-cpu-replicas", 4, "Number of cpu-shared devices advertised per shared CPU")
+	var httpAddress = flag.String("http-address", ":8080", "Address serving the registration state of the device plugins on /registration, empty to disable")
+	var registrationModeFlag = flag.String("registration-mode", string(plugin.RegistrationModeKubelet), "Mechanism used to register the device plugins with the kubelet. Values: kubelet, plugin-watcher")
+	var pluginsRegistryPath = flag.String("plugins-registry-path", plugin.DefaultPluginsRegistryPath, "Directory watched by the kubelet plugin watcher")
+	var cdiEnabled = flag.Bool("cdi", false, "Write CDI spec files for the devices and return CDI devices from Allocate instead of environment variables")
+	var cdiSpecDir = flag.String("cdi-spec-dir", cdi.DefaultSpecDir, "Directory of the generated CDI spec files")
+	var draEnabled = flag.Bool("dra", false, "Serve the CPU devices through a DRA kubelet plugin and publish them in a ResourceSlice")
+	var draDriverName = flag.String("dra-driver-name", dra.DefaultDriverName, "Name of the DRA driver")
+	var draPluginsPath = flag.String("dra-plugins-path", dra.DefaultPluginsPath, "Directory of the DRA kubelet plugin sockets")
+	var devicePluginPath = flag.String("device-plugin-path", pluginapi.DevicePluginPath, "Directory of the device plugin sockets and of the kubelet registration socket")
+	var podResourcesSocket = flag.String("pod-resources-socket", controller.DefaultPodResourcesSocket, "Socket of the kubelet PodResources service")
+	var releaseTerminated = flag.Bool("release-terminated-containers", false, "Release the CPUs of containers that terminated and will not be restarted, without waiting for their pod to be deleted")
 	flag.Parse()
 
 	logger := klog.NewKlogr()
-	logger.Info("Starting cpuset plugin", "node-name", *nodeName, "container-runtime", *containerRuntime, "cgroups-path", *cgroupsPath, "cgroups-driver", *cgroupsDriver)
+	if *nodeName == "" {
+		*nodeName = os.Getenv("NODE_NAME")
+	}
+	if *nodeName == "" {
+		logger.Error(errors.New("node name is not set"), "Set --node-name or the NODE_NAME environment variable")
+		os.Exit(1)
+	}
+	logger.Info("Starting cpuset plugin", "node-name", *nodeName, "container-runtime", *containerRuntime, "cgroups-path", *cgroupsPath, "cgroups-driver", *cgroupsDriver, "cpu-views", *cpuViews)
 
-	state, err := plugin.NewState()
+	registrationMode, err := plugin.ParseRegistrationMode(*registrationModeFlag)
+	if err != nil {
+		logger.Error(err, "Failed to parse registration mode")
+		os.Exit(1)
+	}
+
+	resourcesConfig, err := plugin.ParseResourcesConfig(*resourceDomain, *resources)
+	if err != nil {
+		logger.Error(err, "Failed to parse resources configuration")
+		os.Exit(1)
+	}
+
+	poolConfig, err := config.NewConfig(*nodeName)
+	switch {
+	case err == nil:
+		for _, pool := range poolConfig.Pools {
+			if err := resourcesConfig.AddPool(pool.Name, pool.CPUs, pool.Exclusive); err != nil {
+				logger.Error(err, "Failed to add CPU pool", "pool", pool.Name)
+				os.Exit(1)
+			}
+			logger.Info("Serving CPU pool", "pool", pool.Name, "cpus", pool.CPUs, "exclusive", pool.Exclusive)
+		}
+	case errors.Is(err, config.ErrNoConfigMap) || errors.Is(err, config.ErrNoConfigForNode):
+		logger.Info("No CPU pools configured for node", "reason", err.Error())
+	default:
+		logger.Error(err, "Failed to load CPU pools configuration")
+		os.Exit(1)
+	}
+
+	if *sharedCPUs != "" {
+		if err := resourcesConfig.AddShared(*sharedCPUs, *sharedCPUReplicas); err != nil {
+			logger.Error(err, "Failed to add shared CPU resource")
+			os.Exit(1)
+		}
+	}
+
+	state, err := plugin.NewState(logger)
 	if err != nil {
 		logger.Error(err, "Failed to create daemon state")
 		os.Exit(1)
 	}
+	allCPUs := cpusetutils.New(state.Topology.GetAllCPUs()...)
+	if poolCPUs := resourcesConfig.PoolCPUs(); !poolCPUs.IsSubsetOf(allCPUs) {
+		logger.Error(errors.New("pool CPUs are not online on the node"), "Invalid CPU pools configuration", "poolCPUs", poolCPUs.String(), "onlineCPUs", allCPUs.String())
+		os.Exit(1)
+	}
+	if sharedCPUs := resourcesConfig.SharedCPUs(); !sharedCPUs.IsSubsetOf(allCPUs) {
+		logger.Error(errors.New("shared CPUs are not online on the node"), "Invalid shared CPUs", "sharedCPUs", sharedCPUs.String(), "onlineCPUs", allCPUs.String())
+		os.Exit(1)
+	}
+	// The CPUs of the pools and the shared CPUs are only served by their own resources.
+	state.SetReservedCPUs(resourcesConfig.ReservedCPUs())
 	cpusetController, err := cpuset.NewCPUSetController(*cgroupsDriver, *containerRuntime, *cgroupsPath, logger)
 	if err != nil {
 		logger.Error(err, "Failed to create cpuset controller")
 		os.Exit(1)
 	}
 
+	var cpuViewGenerator *cpuview.Generator
+	if *cpuViews {
+		cpuViewGenerator, err = cpuview.NewGenerator(*cpuViewsDir, logger)
+		if err != nil {
+			logger.Error(err, "Failed to create cpu view generator")
+			os.Exit(1)
+		}
+	}
+
+	adminUnhealthyCPUs, err := cpusetutils.Parse(*unhealthyCPUs)
+	if err != nil {
+		logger.Error(err, "Failed to parse unhealthy CPUs")
+		os.Exit(1)
+	}
+	healthChecker := health.NewChecker(state.Topology, *sysfsPath, *healthCheckInterval, adminUnhealthyCPUs, logger)
+	healthStopCh := make(chan struct{})
+	go healthChecker.Run(healthStopCh)
+
+	var cdiWriter *cdi.Writer
+	if *cdiEnabled {
+		cdiWriter, err = cdi.NewWriter(*cdiSpecDir)
+		if err != nil {
+			logger.Error(err, "Failed to create CDI spec writer")
+			os.Exit(1)
+		}
+	}
+
+	clientset, err := client.NewClient()
+	if err != nil {
+		logger.Error(err, "Failed to create Kubernetes client")
+		os.Exit(1)
+	}
+
+	// DRA driver
+	var draDriver *dra.Driver
+	var claimResolver controller.ClaimResolver
+	if *draEnabled {
+		draCDIWriter := cdiWriter
+		if draCDIWriter == nil {
+			draCDIWriter, err = cdi.NewWriter(*cdiSpecDir)
+			if err != nil {
+				logger.Error(err, "Failed to create CDI spec writer")
+				os.Exit(1)
+			}
+		}
+		dynamicClient, err := client.NewDynamicClient()
+		if err != nil {
+			logger.Error(err, "Failed to create dynamic Kubernetes client")
+			os.Exit(1)
+		}
+		claimReader := dra.NewResourceClaimReader(dynamicClient, *nodeName, *draDriverName)
+		draDriver = dra.NewDriver(*draDriverName, *draPluginsPath, *pluginsRegistryPath, state, draCDIWriter, claimReader, logger)
+		if err := draDriver.Restore(); err != nil {
+			logger.Error(err, "Failed to restore prepared resource claims")
+			os.Exit(1)
+		}
+		claimResolver = draDriver
+
+		publisher := dra.NewResourceSlicePublisher(dynamicClient, clientset, *nodeName, *draDriverName)
+		if err := publisher.Publish(context.Background(), dra.DevicesForTopology(state.Topology, state.GetReservedCPUs())); err != nil {
+			logger.Error(err, "Failed to publish ResourceSlice")
+			os.Exit(1)
+		}
+	}
+
 	// Controller
-	podController, err := controller.NewController(state, cpusetController, logger)
+	podResourcesClient, podResourcesConn, err := controller.NewPodResourcesClient(*podResourcesSocket)
+	if err != nil {
+		logger.Error(err, "CPU Device Plugin cannot connect to Kubelet service")
+		os.Exit(1)
+	}
+	podController, err := controller.NewController(controller.Options{
+		NodeName:                    *nodeName,
+		Client:                      clientset,
+		State:                       state,
+		Resources:                   resourcesConfig,
+		CPUSet:                      cpusetController,
+		PodResources:                podResourcesClient,
+		CPUView:                     cpuViewGenerator,
+		Claims:                      claimResolver,
+		ReleaseTerminatedContainers: *releaseTerminated,
+	}, logger)
 	if err != nil {
 		logger.Error(err, "Failed to create controller")
 		os.Exit(1)
@@ -47,48 +211,69 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Device plugins
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		logger.Error(err, "Failed to create fsnotify watcher")
-		os.Exit(1)
+	// Claims are only prepared once the state holds the CPUs of the running pods.
+	if draDriver != nil {
+		if err := draDriver.Start(); err != nil {
+			logger.Error(err, "Failed to start DRA driver")
+			os.Exit(1)
+		}
 	}
-	watcher.Add(pluginapi.KubeletSocket)
-	defer watcher.Close()
+
+	// Device plugins
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
-	plugins, err := plugin.CreatePluginsForResources(state, logger)
+	plugins, err := plugin.CreatePluginsForResources(resourcesConfig, state, plugin.DriverOptions{
+		CPUView:             cpuViewGenerator,
+		CDI:                 cdiWriter,
+		Health:              healthChecker,
+		RegistrationMode:    registrationMode,
+		PluginsRegistryPath: *pluginsRegistryPath,
+		DevicePluginPath:    *devicePluginPath,
+	}, logger)
 	if err != nil {
 		logger.Error(err, "Failed to create device pluginDriver")
 		os.Exit(1)
 	}
+	supervisor := plugin.NewSupervisor(plugins, *devicePluginPath, logger)
+	supervisorStopCh := make(chan struct{})
+	supervisorDoneCh := make(chan error, 1)
+	go func() {
+		supervisorDoneCh <- supervisor.Run(supervisorStopCh)
+	}()
+
+	if *httpAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/registration", supervisor)
+		go func() {
+			if err := http.ListenAndServe(*httpAddress, mux); err != nil {
+				logger.Error(err, "HTTP server failed")
+			}
+		}()
+	}
 
 	for {
 		select {
 		case sig := <-signalCh:
 			switch sig {
 			case syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT:
-				logger.Info("Received signal, shutting down.", sig)
-				err := plugin.StopPlugins(plugins)
-				if err != nil {
-					logger.Error(err, "Failed to stop pool plugin")
+				logger.Info("Received signal, shutting down.", "signal", sig)
+				close(supervisorStopCh)
+				if err := <-supervisorDoneCh; err != nil {
+					logger.Error(err, "Failed to stop device plugins")
 				}
 				podController.Stop()
+				podResourcesConn.Close()
+				if draDriver != nil {
+					draDriver.Stop()
+				}
+				close(healthStopCh)
 				return
 			}
-			logger.Info("Received signal", sig)
-		case event := <-watcher.Events:
-			logger.Info("Kubelet change event in pluginpath %v", event)
-			err := plugin.StopPlugins(plugins)
-			if err != nil {
-				logger.Error(err, "Failed to stop pool plugins")
-			}
-			plugins, err = plugin.CreatePluginsForResources(state, logger)
-			if err != nil {
-				logger.Error(err, "Failed to create device pluginDriver")
-				os.Exit(1)
-			}
+			logger.Info("Received signal", "signal", sig)
+		case err := <-supervisorDoneCh:
+			logger.Error(err, "Device plugin supervisor failed")
+			os.Exit(1)
 		}
 	}
 }
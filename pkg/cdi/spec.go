@@ -0,0 +1,125 @@
+package cdi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Version is the version of the Container Device Interface specification of the generated spec files.
+const Version = "0.6.0"
+
+// DefaultSpecDir is the directory where CDI-aware runtimes look for spec files.
+const DefaultSpecDir = "/var/run/cdi"
+
+// Spec is a CDI spec file describing the devices of a kind.
+type Spec struct {
+	Version        string            `json:"cdiVersion"`
+	Kind           string            `json:"kind"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+	Devices        []Device          `json:"devices"`
+	ContainerEdits ContainerEdits    `json:"containerEdits,omitempty"`
+}
+
+// Device is a device of a CDI spec.
+type Device struct {
+	Name           string            `json:"name"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+	ContainerEdits ContainerEdits    `json:"containerEdits"`
+}
+
+// ContainerEdits are the changes applied to a container that is given a device.
+type ContainerEdits struct {
+	Env    []string `json:"env,omitempty"`
+	Mounts []Mount  `json:"mounts,omitempty"`
+}
+
+// Mount is a mount applied to a container that is given a device.
+type Mount struct {
+	HostPath      string   `json:"hostPath"`
+	ContainerPath string   `json:"containerPath"`
+	Type          string   `json:"type,omitempty"`
+	Options       []string `json:"options,omitempty"`
+}
+
+// Writer writes CDI spec files into a spec directory.
+type Writer struct {
+	dir string
+}
+
+// NewWriter creates a new Writer for the spec directory.
+func NewWriter(dir string) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create CDI spec directory: %v", err)
+	}
+	return &Writer{dir: dir}, nil
+}
+
+// Write writes the spec to a file named after its kind.
+func (w *Writer) Write(spec *Spec) error {
+	return w.WriteAs(spec.Kind, spec)
+}
+
+// WriteAs writes the spec to a file named after name, for kinds whose devices are spread over several files.
+// The file is replaced atomically, since runtimes may be reading the directory concurrently.
+func (w *Writer) WriteAs(name string, spec *Spec) error {
+	spec.Version = Version
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := w.specPath(name)
+	tmp, err := os.CreateTemp(w.dir, ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Read reads the spec file written with the given kind or name, or returns nil if there is none.
+func (w *Writer) Read(name string) (*Spec, error) {
+	data, err := os.ReadFile(w.specPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	spec := &Spec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("failed to parse CDI spec %s: %v", name, err)
+	}
+	return spec, nil
+}
+
+// Remove deletes the spec file written with the given kind or name.
+func (w *Writer) Remove(name string) error {
+	if err := os.Remove(w.specPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// specPath returns the path of the spec file of a kind or name, e.g. stefanaki.github.com-core.json.
+func (w *Writer) specPath(name string) string {
+	return filepath.Join(w.dir, strings.ReplaceAll(name, "/", "-")+".json")
+}
+
+// QualifiedName returns the fully qualified name of a device of a kind, e.g. stefanaki.github.com/core=3.
+func QualifiedName(kind string, device string) string {
+	return fmt.Sprintf("%s=%s", kind, device)
+}
@@ -1,12 +1,31 @@
 package client
 
 import (
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 func NewClient() (*kubernetes.Clientset, error) {
+	config, err := newConfig()
+	if err != nil {
+		return nil, err
+	}
+	// Create the Kubernetes client
+	return kubernetes.NewForConfig(config)
+}
+
+// NewDynamicClient creates a client for resources whose types are not compiled in, such as ResourceSlices.
+func NewDynamicClient() (dynamic.Interface, error) {
+	config, err := newConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+func newConfig() (*rest.Config, error) {
 	// Load the Kubernetes configuration
 	rules := clientcmd.NewDefaultClientConfigLoadingRules()
 	kubeconfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
@@ -17,6 +36,5 @@ func NewClient() (*kubernetes.Clientset, error) {
 			return nil, err
 		}
 	}
-	// Create the Kubernetes client
-	return kubernetes.NewForConfig(config)
+	return config, nil
 }
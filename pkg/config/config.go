@@ -3,12 +3,20 @@ package config
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/stefanaki/cpuset-plugin/pkg/client"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes"
 )
 
+// ErrNoConfigMap is returned when the cpu-pools ConfigMap does not exist.
+var ErrNoConfigMap = errors.New("cpu-pools config map not found")
+
+// ErrNoConfigForNode is returned when none of the pool configurations selects the node.
+var ErrNoConfigForNode = errors.New("no config found for node")
+
 type PoolConfig struct {
 	NodeSelector map[string]string `yaml:"nodeSelector"`
 	Pools        []Pool            `yaml:"pools"`
@@ -61,6 +69,9 @@ func getCPUSetConfigMap(client *kubernetes.Clientset) (map[string]string, error)
 		ConfigMaps("kube-system").
 		Get(context.TODO(), "cpu-pools", metav1.GetOptions{})
 
+	if apierrors.IsNotFound(err) {
+		return nil, ErrNoConfigMap
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -73,7 +84,7 @@ func getNodeLabels(client *kubernetes.Clientset, nodeName string) (map[string]st
 		Nodes().
 		Get(context.TODO(), nodeName, metav1.GetOptions{})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to get node %s: %v", nodeName, err)
 	}
 	return node.Labels, nil
 }
@@ -94,5 +105,5 @@ func getPoolsForNode(rawConfig map[string]string, nodeLabels map[string]string)
 			}
 		}
 	}
-	return nil, nil, errors.New("no config found for node")
+	return nil, nil, ErrNoConfigForNode
 }
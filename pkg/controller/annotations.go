@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// placementAnnotationPrefix prefixes the resource domain in the keys of the placement annotations,
+// e.g. placement.stefanaki.github.com/benchmark for the container benchmark.
+const placementAnnotationPrefix = "placement."
+
+// Placement is the placement of a container, published as a JSON annotation on its pod.
+type Placement struct {
+	ContainerID    string                `json:"containerID,omitempty"`
+	CPUs           string                `json:"cpus"`
+	Mems           string                `json:"mems"`
+	AllocationType plugin.AllocationType `json:"allocationType"`
+	Devices        map[string][]string   `json:"devices,omitempty"`
+	// Stale is set once the allocation of the container is released while its pod remains.
+	Stale bool `json:"stale,omitempty"`
+}
+
+// PlacementAnnotationKey returns the key of the placement annotation of a container.
+func PlacementAnnotationKey(domain string, containerName string) string {
+	return placementAnnotationPrefix + domain + "/" + containerName
+}
+
+// newPlacement returns the placement of a container pinned to the CPUs of the allocation.
+func newPlacement(containerID string, cpus string, mems string, allocation plugin.Allocation) Placement {
+	allocationType := allocation.Type
+	if allocationType == "" {
+		allocationType = plugin.AllocationTypeClaim
+	}
+	devices := make(map[string][]string, len(allocation.Devices))
+	for resourceName, deviceIDs := range allocation.Devices {
+		devices[resourceName] = append([]string(nil), deviceIDs...)
+		sort.Strings(devices[resourceName])
+	}
+	return Placement{
+		ContainerID:    containerID,
+		CPUs:           cpus,
+		Mems:           mems,
+		AllocationType: allocationType,
+		Devices:        devices,
+	}
+}
+
+// annotatePlacement publishes the placement of a container on its pod, unless the pod already holds it.
+func (c *Controller) annotatePlacement(pod *corev1.Pod, containerName string, placement Placement) {
+	value, err := json.Marshal(placement)
+	if err != nil {
+		c.logger.Error(err, "Failed to encode placement", "pod", pod.Name, "name", containerName)
+		return
+	}
+	key := PlacementAnnotationKey(c.resources.Domain, containerName)
+	if pod.Annotations[key] == string(value) {
+		return
+	}
+	if err := c.patchAnnotation(pod, key, string(value)); err != nil {
+		c.logger.Error(err, "Failed to annotate pod with placement", "pod", pod.Name, "name", containerName)
+	}
+}
+
+// markPlacementStale marks the placement annotation of a released container as stale, so that it still
+// tells where the container ran.
+func (c *Controller) markPlacementStale(pod *corev1.Pod, containerName string) {
+	key := PlacementAnnotationKey(c.resources.Domain, containerName)
+	value, ok := pod.Annotations[key]
+	if !ok {
+		return
+	}
+	var placement Placement
+	if err := json.Unmarshal([]byte(value), &placement); err != nil || placement.Stale {
+		return
+	}
+	placement.Stale = true
+	c.annotatePlacement(pod, containerName, placement)
+}
+
+// patchAnnotation sets an annotation of the pod with a merge patch.
+func (c *Controller) patchAnnotation(pod *corev1.Pod, key string, value string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.client.CoreV1().Pods(pod.Namespace).Patch(context.TODO(), pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to patch pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	cpusetutils "k8s.io/utils/cpuset"
+)
+
+// ClaimResolver returns the CPUs of the resource claims prepared on the node.
+type ClaimResolver interface {
+	PreparedCPUs(namespace string, name string) (cpusetutils.CPUSet, bool)
+}
+
+// claimCPUs returns the CPUs of the prepared resource claims of the container,
+// and whether the container uses any resource claim served by the resolver.
+func (c *Controller) claimCPUs(pod *corev1.Pod, container corev1.Container) (cpusetutils.CPUSet, bool) {
+	cpus := cpusetutils.New()
+	if c.claims == nil {
+		return cpus, false
+	}
+	found := false
+	for _, claim := range container.Resources.Claims {
+		claimName, ok := resourceClaimName(pod, claim.Name)
+		if !ok {
+			continue
+		}
+		claimCPUs, ok := c.claims.PreparedCPUs(pod.Namespace, claimName)
+		if !ok {
+			c.logger.Info("Resource claim is not prepared by the driver", "pod", pod.Name, "claim", claimName)
+			continue
+		}
+		cpus = cpus.Union(claimCPUs)
+		found = true
+	}
+	return cpus, found
+}
+
+// resourceClaimName returns the name of the ResourceClaim of a pod claim, either generated from a template
+// and reported in the pod status, or referenced directly in the pod spec.
+func resourceClaimName(pod *corev1.Pod, podClaimName string) (string, bool) {
+	for _, status := range pod.Status.ResourceClaimStatuses {
+		if status.Name == podClaimName && status.ResourceClaimName != nil {
+			return *status.ResourceClaimName, true
+		}
+	}
+	for _, claim := range pod.Spec.ResourceClaims {
+		if claim.Name == podClaimName && claim.Source.ResourceClaimName != nil {
+			return *claim.Source.ResourceClaimName, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// containerDevices returns the device IDs assigned to a container, keyed by resource name.
+// The kubelet reports one entry per device, while Allocate reserves all the devices of a resource at once,
+// so the IDs are merged to match the keys of the reservations.
+func containerDevices(containerResources *podresources.ContainerResources) map[string][]string {
+	devices := make(map[string][]string)
+	for _, device := range containerResources.GetDevices() {
+		devices[device.GetResourceName()] = append(devices[device.GetResourceName()], device.GetDeviceIds()...)
+	}
+	return devices
+}
+
+// allContainers returns the init containers, including restartable sidecars, the regular containers and the
+// ephemeral containers of the pod.
+func allContainers(pod *corev1.Pod) []corev1.Container {
+	containers := make([]corev1.Container, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers)+len(pod.Spec.EphemeralContainers))
+	containers = append(containers, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+	for _, container := range pod.Spec.EphemeralContainers {
+		containers = append(containers, corev1.Container(container.EphemeralContainerCommon))
+	}
+	return containers
+}
+
+// podContainer returns the container of any kind of the pod with the given name.
+func podContainer(pod *corev1.Pod, name string) (corev1.Container, bool) {
+	for _, container := range allContainers(pod) {
+		if container.Name == name {
+			return container, true
+		}
+	}
+	return corev1.Container{}, false
+}
+
+// containerStatus returns the status of the container of any kind of the pod with the given name.
+func containerStatus(pod *corev1.Pod, name string) (corev1.ContainerStatus, bool) {
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses, pod.Status.EphemeralContainerStatuses} {
+		for _, status := range statuses {
+			if status.Name == name {
+				return status, true
+			}
+		}
+	}
+	return corev1.ContainerStatus{}, false
+}
+
+// isStarted reports whether the container has been created by the runtime, and thus has a cgroup to pin.
+func isStarted(pod *corev1.Pod, name string) bool {
+	status, ok := containerStatus(pod, name)
+	return ok && status.ContainerID != ""
+}
+
+// isCompletedInitContainer reports whether the container is a regular init container that has terminated.
+// The kubelet hands the devices of completed init containers to the containers started after them,
+// so their allocations are released rather than accounted for twice. Restartable sidecar init containers keep their devices.
+func isCompletedInitContainer(pod *corev1.Pod, name string) bool {
+	for _, container := range pod.Spec.InitContainers {
+		if container.Name != name {
+			continue
+		}
+		if container.RestartPolicy != nil && *container.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+			return false
+		}
+		status, ok := containerStatus(pod, name)
+		return ok && status.State.Terminated != nil
+	}
+	return false
+}
+
+// isTerminatedForGood reports whether the container has terminated and will not be restarted by the kubelet.
+// Restartable sidecar init containers and the containers of pods restarted Always are restarted.
+func isTerminatedForGood(pod *corev1.Pod, name string) bool {
+	status, ok := containerStatus(pod, name)
+	if !ok || status.State.Terminated == nil {
+		return false
+	}
+	for _, container := range pod.Spec.InitContainers {
+		if container.Name == name {
+			return container.RestartPolicy == nil || *container.RestartPolicy != corev1.ContainerRestartPolicyAlways
+		}
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		if container.Name == name {
+			return true
+		}
+	}
+	switch pod.Spec.RestartPolicy {
+	case corev1.RestartPolicyNever:
+		return true
+	case corev1.RestartPolicyOnFailure:
+		return status.State.Terminated.ExitCode == 0
+	}
+	return false
+}
+
+// isTerminalPhase reports whether all the containers of the pod have terminated for good.
+func isTerminalPhase(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
@@ -1,71 +1,116 @@
 package controller
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"github.com/go-logr/logr"
-	"github.com/stefanaki/cpuset-plugin/pkg/client"
 	"github.com/stefanaki/cpuset-plugin/pkg/cpuset"
+	"github.com/stefanaki/cpuset-plugin/pkg/cpuview"
 	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
+	"golang.org/x/exp/maps"
 	"golang.org/x/sys/unix"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"io"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	podresources "k8s.io/kubelet/pkg/apis/podresources/v1"
 	cpusetutils "k8s.io/utils/cpuset"
-	"net"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
+// maxRetries is the number of times a pod is retried with backoff before the controller gives up on it.
+const maxRetries = 5
+
+// DefaultPodResourcesSocket is the socket of the kubelet PodResources service.
+const DefaultPodResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
 // Controller is responsible for managing the reconciliation and event handling of Pods in Kubernetes.
 type Controller struct {
-	state                  *plugin.State
-	informerFactory        informers.SharedInformerFactory
-	queue                  workqueue.RateLimitingInterface
-	client                 kubernetes.Interface
-	informer               cache.SharedInformer
-	cpusetController       *cpuset.CPUSetController
-	podResourcesClient     podresources.PodResourcesListerClient
-	podresourcesConnection *grpc.ClientConn
-	stopCh                 *chan struct{}
-	logger                 logr.Logger
+	nodeName           string
+	state              StateStore
+	resources          plugin.ResourcesConfig
+	informerFactory    informers.SharedInformerFactory
+	queue              workqueue.RateLimitingInterface
+	client             kubernetes.Interface
+	informer           cache.SharedInformer
+	podLister          corelisters.PodLister
+	cpusetController   CPUSetApplier
+	cpuView            *cpuview.Generator
+	claims             ClaimResolver
+	releaseTerminated  bool
+	recorder           record.EventRecorder
+	podResourcesClient podresources.PodResourcesListerClient
+	// deletedPods holds the last state of the deleted pods, keyed like the work queue, until a worker releases their allocations.
+	deletedPods  map[string]*corev1.Pod
+	deletedMutex sync.Mutex
+	stopCh       *chan struct{}
+	stopOnce     sync.Once
+	logger       logr.Logger
 }
 
-// NewController creates a new instance of the Controller.
-func NewController(state *plugin.State, cpusetController *cpuset.CPUSetController, logger logr.Logger) (*Controller, error) {
-	controller := &Controller{}
+// Options holds the dependencies of the Controller.
+type Options struct {
+	// NodeName is the node whose pods are watched.
+	NodeName string
+	// Client is the Kubernetes client used to watch the pods.
+	Client kubernetes.Interface
+	// State stores the allocations and reservations shared with the device plugins.
+	State StateStore
+	// Resources are the resources served by the device plugins.
+	Resources plugin.ResourcesConfig
+	// CPUSet applies the cpusets to the container cgroups.
+	CPUSet CPUSetApplier
+	// PodResources is the client of the kubelet PodResources service.
+	PodResources podresources.PodResourcesListerClient
+	// CPUView generates the CPU view files mounted into containers, nil to disable.
+	CPUView *cpuview.Generator
+	// Claims resolves the CPUs of the DRA resource claims of the containers, nil to disable.
+	Claims ClaimResolver
+	// Recorder records the Events of the pods, nil to record them through Client.
+	Recorder record.EventRecorder
+	// ReleaseTerminatedContainers releases the allocations of the containers that terminated and will not be restarted,
+	// while their pod remains.
+	ReleaseTerminatedContainers bool
+}
 
-	// Create the Kubernetes clientset
-	clientset, err := client.NewClient()
-	if err != nil {
-		return nil, err
+// NewController creates a new instance of the Controller.
+// Only the pods scheduled on the node are watched.
+func NewController(options Options, logger logr.Logger) (*Controller, error) {
+	if options.Client == nil || options.State == nil || options.CPUSet == nil || options.PodResources == nil {
+		return nil, errors.New("the client, state, cpuset applier and pod resources client of the controller are required")
 	}
+	controller := &Controller{}
 
 	// Create the work queue and informer factory
 	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
-	informerFactory := informers.NewSharedInformerFactory(clientset, 30*time.Second)
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(options.Client, 30*time.Second,
+		informers.WithTweakListOptions(func(listOptions *metav1.ListOptions) {
+			listOptions.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", options.NodeName).String()
+		}))
 
 	// Create the Pod informer and add event handlers
 	podInformer := informerFactory.Core().V1().Pods().Informer()
-	_, err = podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	_, err := podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			controller.handleAddPod(obj.(*corev1.Pod))
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			controller.handleUpdatePod(newObj.(*corev1.Pod))
 		},
-		DeleteFunc: nil,
+		DeleteFunc: func(obj interface{}) {
+			controller.handleDeletePod(obj)
+		},
 	})
 	if err != nil {
 		return nil, err
@@ -77,25 +122,25 @@ func NewController(state *plugin.State, cpusetController *cpuset.CPUSetControlle
 		return nil, err
 	}
 
-	controller.state = state
+	controller.nodeName = options.NodeName
+	controller.state = options.State
+	controller.resources = options.Resources
 	controller.informerFactory = informerFactory
 	controller.queue = queue
 	controller.informer = podInformer
-	controller.client = clientset
-	controller.cpusetController = cpusetController
-	controller.logger = logger.WithName("controller")
-
-	conn, err := grpc.Dial("/var/lib/kubelet/pod-resources/kubelet.sock", grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
-			d := &net.Dialer{}
-			return d.DialContext(ctx, "unix", addr)
-		}))
-	if err != nil {
-		controller.logger.Error(err, "CPU Device Plugin cannot connect to Kubelet service")
-		return nil, err
+	controller.podLister = informerFactory.Core().V1().Pods().Lister()
+	controller.client = options.Client
+	controller.cpusetController = options.CPUSet
+	controller.cpuView = options.CPUView
+	controller.claims = options.Claims
+	controller.releaseTerminated = options.ReleaseTerminatedContainers
+	controller.recorder = options.Recorder
+	if controller.recorder == nil {
+		controller.recorder = newEventRecorder(options.Client, options.NodeName)
 	}
-	controller.podResourcesClient = podresources.NewPodResourcesListerClient(conn)
-	controller.podresourcesConnection = conn
+	controller.podResourcesClient = options.PodResources
+	controller.deletedPods = make(map[string]*corev1.Pod)
+	controller.logger = logger.WithName("controller")
 
 	return controller, nil
 }
@@ -112,12 +157,17 @@ func (c *Controller) Run(threadiness int, stopCh *chan struct{}) error {
 		return errors.New("failed to sync Pod Controller from cache, Are you sure everything is properly connected")
 	}
 
+	// The state is rebuilt before the device plugins start advertising, so that CPUs used by running pods are not offered again.
+	if err := c.seedState(); err != nil {
+		return fmt.Errorf("failed to rebuild state from the kubelet: %v", err)
+	}
+
 	c.logger.Info("Starting controller worker threads...", "threadiness", threadiness)
 	for i := 0; i < threadiness; i++ {
 		go wait.Until(c.runWorker, time.Second, *stopCh)
 	}
 
-	// c.StartReconciliation()
+	c.StartReconciliation()
 	c.logger.Info("Controller successfully initialized, worker threads are now serving requests")
 	return nil
 }
@@ -139,18 +189,69 @@ func (c *Controller) processNextItem() bool {
 	return true
 }
 
-// processNextItemInQueue processes the item in the work queue.
+// processNextItemInQueue processes the pod whose key is in the work queue, retrying it with backoff when it fails.
 func (c *Controller) processNextItemInQueue(obj interface{}) {
 	defer c.queue.Done(obj)
 
-	pod, ok := obj.(*corev1.Pod)
+	key, ok := obj.(string)
 	if !ok {
 		c.queue.Forget(obj)
-		c.logger.Error(fmt.Errorf("expected type *v1.Pod, but got %T", obj), "failed to process item in queue")
+		c.logger.Error(fmt.Errorf("expected type string, but got %T", obj), "failed to process item in queue")
+		return
+	}
+
+	err := c.syncPod(key)
+	if err == nil {
+		c.queue.Forget(key)
+		return
+	}
+	if c.queue.NumRequeues(key) < maxRetries {
+		c.logger.Error(err, "Failed to process pod, retrying", "key", key, "retries", c.queue.NumRequeues(key))
+		c.queue.AddRateLimited(key)
 		return
 	}
+	c.queue.Forget(key)
+	c.logger.Error(err, "Failed to process pod, giving up", "key", key, "retries", maxRetries)
+	c.recordGaveUp(key, err)
+}
 
-	c.handlePod(pod)
+// syncPod processes the current version of the pod with the given namespace/name key.
+func (c *Controller) syncPod(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		c.logger.Error(err, "Invalid pod key", "key", key)
+		return nil
+	}
+	pod, err := c.podLister.Pods(namespace).Get(name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	// A pod recreated with the same name, e.g. by a StatefulSet, has a different UID than the deleted one.
+	if deleted, ok := c.popDeletedPod(key); ok && (pod == nil || pod.UID != deleted.UID) {
+		c.logger.Info("Pod deleted, releasing its allocations", "name", deleted.Name)
+		c.deletePod(deleted)
+	}
+	if pod == nil {
+		return nil
+	}
+	if pod.GetDeletionTimestamp() != nil || (c.releaseTerminated && isTerminalPhase(pod)) {
+		c.deletePod(pod)
+		return nil
+	}
+	if !c.validatePod(pod) {
+		return nil
+	}
+	return c.handlePod(pod)
+}
+
+// enqueuePod adds the key of the pod to the work queue.
+func (c *Controller) enqueuePod(pod *corev1.Pod) {
+	key, err := cache.MetaNamespaceKeyFunc(pod)
+	if err != nil {
+		c.logger.Error(err, "Failed to get pod key", "name", pod.Name)
+		return
+	}
+	c.queue.Add(key)
 }
 
 // StartReconciliation starts the periodic reconciliation loop.
@@ -161,11 +262,18 @@ func (c *Controller) StartReconciliation() {
 
 // startReconciliationLoop is the main loop for the periodic reconciliation.
 func (c *Controller) startReconciliationLoop() {
-	timeToReconcile := time.NewTicker(5 * time.Second)
+	timeToReconcile := time.NewTicker(reconcileInterval)
 	for {
 		select {
 		case <-timeToReconcile.C:
-			// TODO: Implement reconciliation logic here...
+			report, err := c.reconcile()
+			if err != nil {
+				c.logger.Error(err, "Reconciliation failed")
+				continue
+			}
+			if !report.isEmpty() {
+				c.logger.Info("Reconciliation fixed drift", "repinned", report.Repinned, "dropped", report.Dropped, "adopted", report.Adopted, "releasedReservations", report.ReleasedReservations)
+			}
 		case <-*c.stopCh:
 			c.logger.Info("Shutting down the periodic reconciliation thread")
 			timeToReconcile.Stop()
@@ -193,119 +301,295 @@ func (c *Controller) WatchErrorHandler(r *cache.Reflector, err error) {
 }
 
 // Stop initiates a graceful shutdown procedure for the Controller.
+// The stop channel is closed, so that the informers, the workers and the reconciliation loop all stop.
 func (c *Controller) Stop() {
-	*c.stopCh <- struct{}{}
-	c.podresourcesConnection.Close()
-	c.queue.ShutDown()
+	c.stopOnce.Do(func() {
+		close(*c.stopCh)
+		c.queue.ShutDown()
+	})
 }
 
 func (c *Controller) handleAddPod(pod *corev1.Pod) {
 	if c.validatePod(pod) {
 		fmt.Printf("Pod %s added and added to queue\n", pod.Name)
-		c.queue.Add(pod)
+		c.enqueuePod(pod)
 	}
 }
 
 func (c *Controller) handleUpdatePod(pod *corev1.Pod) {
-	if c.validatePod(pod) {
-		if pod.GetDeletionTimestamp() == nil {
-			c.queue.Add(pod)
-		} else {
-			c.logger.Info("PODPODPOD")
-			c.deletePod(pod)
+	if c.validatePod(pod) || pod.GetDeletionTimestamp() != nil || (c.releaseTerminated && isTerminalPhase(pod)) {
+		c.enqueuePod(pod)
+	}
+}
+
+// handleDeletePod queues the release of the allocations of a deleted pod, including pods deleted while the watch was
+// disconnected, which are delivered as cache.DeletedFinalStateUnknown tombstones. The allocations are released by a worker,
+// after any sync of the pod in flight, so that they cannot be added again once released.
+func (c *Controller) handleDeletePod(obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			c.logger.Error(fmt.Errorf("unexpected object of type %T", obj), "Failed to handle pod deletion")
+			return
 		}
+		pod, ok = tombstone.Obj.(*corev1.Pod)
+		if !ok {
+			c.logger.Error(fmt.Errorf("unexpected tombstone object of type %T", tombstone.Obj), "Failed to handle pod deletion")
+			return
+		}
+	}
+	if pod.Spec.NodeName != c.nodeName {
+		return
 	}
+	key, err := cache.MetaNamespaceKeyFunc(pod)
+	if err != nil {
+		c.logger.Error(err, "Failed to get pod key", "name", pod.Name)
+		return
+	}
+	c.deletedMutex.Lock()
+	c.deletedPods[key] = pod
+	c.deletedMutex.Unlock()
+	c.queue.Add(key)
+}
+
+// popDeletedPod returns and forgets the last state of the deleted pod with the given key.
+func (c *Controller) popDeletedPod(key string) (*corev1.Pod, bool) {
+	c.deletedMutex.Lock()
+	defer c.deletedMutex.Unlock()
+	pod, ok := c.deletedPods[key]
+	delete(c.deletedPods, key)
+	return pod, ok
 }
 
+// deletePod releases the allocations of every container of the pod, and its pod-wide allocation.
 func (c *Controller) deletePod(pod *corev1.Pod) {
-	for _, container := range pod.Spec.Containers {
-		for resourceName := range container.Resources.Requests {
-			if !strings.Contains(resourceName.String(), plugin.Vendor) {
-				continue
+	c.releaseAllocation(podAllocationKey(pod))
+	for _, container := range allContainers(pod) {
+		c.releaseAllocation(plugin.ContainerKey(string(pod.UID), container.Name))
+	}
+}
+
+// isReleased reports whether the allocation of the container is released while its pod remains,
+// i.e. when it is a completed init container, or when it terminated for good and releaseTerminated is set.
+func (c *Controller) isReleased(pod *corev1.Pod, name string) bool {
+	if isCompletedInitContainer(pod, name) {
+		return true
+	}
+	return c.releaseTerminated && isTerminatedForGood(pod, name)
+}
+
+// releaseAllocation removes the allocation stored under key and its CPU view files.
+func (c *Controller) releaseAllocation(key string) {
+	allocation, ok := c.state.GetAllocation(key)
+	if !ok {
+		return
+	}
+	c.removeCPUViews(key, allocation)
+	c.state.RemoveAllocation(key)
+}
+
+// releaseContainer releases the allocation of a container while its pod remains.
+// The kubelet hands the devices of a completed init container to the containers started after it, whose reservations
+// were dropped when the init container was pinned, so the devices of the containers that are not pinned yet are
+// reserved again before the allocation is removed, leaving no gap in which their CPUs could be allocated twice.
+func (c *Controller) releaseContainer(pod *corev1.Pod, podResources *podresources.PodResources, name string) {
+	key := plugin.ContainerKey(string(pod.UID), name)
+	if _, ok := c.state.GetAllocation(key); !ok {
+		return
+	}
+	allocations := c.state.GetAllocations()
+	reservations := c.state.GetReservations()
+	for _, containerResources := range podResources.GetContainers() {
+		other := containerResources.GetName()
+		if other == name || c.isReleased(pod, other) {
+			continue
+		}
+		if _, ok := allocations[plugin.ContainerKey(string(pod.UID), other)]; ok {
+			continue
+		}
+		for resourceName, deviceIDs := range containerDevices(containerResources) {
+			if _, ok := reservations[plugin.ReservationKey(resourceName, deviceIDs)]; !ok {
+				c.reserveDevices(resourceName, deviceIDs)
 			}
-			c.state.RemoveAllocation(cpuset.GetContainerInfo(container, *pod).ContainerID)
 		}
 	}
+	c.releaseAllocation(key)
 }
 
-func (c *Controller) handlePod(pod *corev1.Pod) {
+func (c *Controller) handlePod(pod *corev1.Pod) error {
 	c.logger.Info("Processing Pod...", "name", pod.Name)
 
-	podResources, err := c.podResourcesClient.Get(context.TODO(), &podresources.GetPodResourcesRequest{
-		PodName:      pod.Name,
-		PodNamespace: pod.Namespace,
-	})
+	podResources, err := c.getPodResources(pod)
 	if err != nil {
-		c.logger.Error(err, "Failed to get pod resources", "name", pod.Name)
-		return
+		return fmt.Errorf("failed to get pod resources: %v", err)
+	}
+	return c.applyPodResources(pod, podResources)
+}
+
+// applyPodResources pins the containers of the pod to the devices assigned to them by the kubelet,
+// and records their allocations.
+func (c *Controller) applyPodResources(pod *corev1.Pod, podResources *podresources.PodResources) error {
+	var err error
+	if containers := c.podScopeContainers(pod); containers != nil {
+		return c.handlePodScope(pod, podResources, containers)
 	}
 
-	for _, container := range pod.Spec.Containers {
+	for _, container := range allContainers(pod) {
+		if c.isReleased(pod, container.Name) {
+			c.releaseContainer(pod, podResources, container.Name)
+			c.markPlacementStale(pod, container.Name)
+			continue
+		}
+		if !isStarted(pod, container.Name) {
+			continue
+		}
+		claimCPUs, hasClaims := c.claimCPUs(pod, container)
+		if !c.requestsManagedResources(container) && !hasClaims {
+			continue
+		}
 		containerInfo := cpuset.GetContainerInfo(container, *pod)
-		for resourceName := range container.Resources.Requests {
-			if !strings.Contains(resourceName.String(), plugin.Vendor) {
+
+		// All the devices of the container are applied at once, as a single allocation.
+		devices := make(map[string][]string)
+		for _, containerResources := range podResources.GetContainers() {
+			if containerResources.Name == container.Name {
+				devices = containerDevices(containerResources)
+			}
+		}
+		allocation := plugin.Allocation{}
+		if len(devices) > 0 {
+			allocation, err = c.resources.AllocationForDevices(c.state.GetTopology(), devices)
+			if err != nil {
+				c.logger.Error(err, "Failed to get CPUs of container devices", "name", container.Name)
+				continue
+			}
+		}
+
+		// The CPUs of resource claims are accounted for when the claims are prepared, and are only pinned here.
+		cpus, _ := cpusetutils.Parse(allocation.CPUs)
+		cpus = cpus.Union(claimCPUs)
+		if cpus.IsEmpty() {
+			continue
+		}
+
+		// A restarted container gets a new ID and a new cgroup, which is pinned again.
+		key := plugin.ContainerKey(containerInfo.PodID, container.Name)
+		if previous, ok := c.state.GetAllocation(key); ok && previous.ContainerID != containerInfo.ContainerID {
+			c.logger.Info("Container restarted, re-applying cpuset", "name", container.Name, "previousContainerID", previous.ContainerID, "containerID", containerInfo.ContainerID)
+		}
+
+		mems := c.memsForCPUs(cpus)
+		changed := c.cpusetChanged(key, containerInfo, allocation, cpus, mems)
+		err = c.cpusetController.UpdateCPUSet(containerInfo, cpus.String(), mems)
+		if err != nil {
+			c.recordFailed(pod, container.Name, err)
+			return fmt.Errorf("failed to update cpuset for container %s: %v", container.Name, err)
+		}
+		if changed {
+			c.logger.Info("Applied cpuset to container", "pod", pod.Name, "name", container.Name, "cpus", cpus.String(), "mems", mems)
+			c.recordApplied(pod, container, cpus, mems, allocation, c.isExclusive(allocation))
+		}
+		c.updateCPUViews(allocation.Devices, cpus)
+		c.annotatePlacement(pod, container.Name, newPlacement(containerInfo.ContainerID, cpus.String(), mems, allocation))
+		if allocation.CPUs != "" {
+			allocation.ContainerID = containerInfo.ContainerID
+			c.state.AddAllocation(key, allocation)
+		}
+	}
+	return nil
+}
+
+// memsForCPUs returns the NUMA nodes of the CPUs, formatted as a cpuset.mems list.
+func (c *Controller) memsForCPUs(cpus cpusetutils.CPUSet) string {
+	return cpusetutils.New(c.state.GetTopology().GetNUMANodesForCPUs(cpus.List())...).String()
+}
+
+// requestsManagedResources reports whether the container requests any of the resources of the daemon.
+func (c *Controller) requestsManagedResources(container corev1.Container) bool {
+	for resourceName := range container.Resources.Requests {
+		if c.resources.IsManaged(resourceName.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateCPUViews regenerates the CPU view files of the container's devices to match the applied cpuset.
+func (c *Controller) updateCPUViews(devices map[string][]string, cpus cpusetutils.CPUSet) {
+	if c.cpuView == nil {
+		return
+	}
+	for resourceName, deviceIDs := range devices {
+		key := cpuview.Key(resourceName, deviceIDs)
+		if !c.cpuView.Exists(key) {
+			continue
+		}
+		if _, err := c.cpuView.Write(key, cpus); err != nil {
+			c.logger.Error(err, "Failed to update cpu view files", "resource", resourceName, "devices", deviceIDs)
+		}
+	}
+}
+
+// allocationDevices returns the devices of an allocation, one map per container for pod-wide allocations.
+func allocationDevices(allocation plugin.Allocation) []map[string][]string {
+	if len(allocation.ContainerDevices) > 0 {
+		return maps.Values(allocation.ContainerDevices)
+	}
+	return []map[string][]string{allocation.Devices}
+}
+
+// removeCPUViews deletes the CPU view files of the devices of the allocation stored under key.
+// The files of devices still held by another allocation or by a reservation, e.g. devices handed from a completed
+// init container to an app container, are kept since they are mounted into the other container.
+func (c *Controller) removeCPUViews(key string, allocation plugin.Allocation) {
+	if c.cpuView == nil {
+		return
+	}
+	held := make(map[string]struct{})
+	for reservationKey := range c.state.GetReservations() {
+		held[reservationKey] = struct{}{}
+	}
+	for otherKey, other := range c.state.GetAllocations() {
+		if otherKey == key {
+			continue
+		}
+		for _, devices := range allocationDevices(other) {
+			for resourceName, deviceIDs := range devices {
+				held[plugin.ReservationKey(resourceName, deviceIDs)] = struct{}{}
+			}
+		}
+	}
+	for _, devices := range allocationDevices(allocation) {
+		for resourceName, deviceIDs := range devices {
+			if _, ok := held[plugin.ReservationKey(resourceName, deviceIDs)]; ok {
 				continue
 			}
-			for _, containerResources := range podResources.GetPodResources().GetContainers() {
-				if containerResources.Name != container.Name {
-					continue
-				}
-				cpus := cpusetutils.New()
-				allocationType := plugin.AllocationTypeCPU
-				for _, device := range containerResources.GetDevices() {
-					for _, deviceId := range device.GetDeviceIds() {
-						id, _ := strconv.Atoi(deviceId)
-						if strings.Contains(resourceName.String(), string(plugin.ResourceNameNUMA)) {
-							cpus = cpus.Union(cpusetutils.New(c.state.Topology.GetAllCPUsInNUMA(id)...))
-							allocationType = plugin.AllocationTypeNUMA
-						} else if strings.Contains(resourceName.String(), string(plugin.ResourceNameSocket)) {
-							cpus = cpus.Union(cpusetutils.New(c.state.Topology.GetAllCPUsInSocket(id)...))
-							allocationType = plugin.AllocationTypeSocket
-						} else if strings.Contains(resourceName.String(), string(plugin.ResourceNameCore)) {
-							cpus = cpus.Union(cpusetutils.New(c.state.Topology.GetAllCPUsInCore(id)...))
-							allocationType = plugin.AllocationTypeCore
-						} else {
-							cpus = cpus.Union(cpusetutils.New(id))
-						}
-					}
-				}
-				mems := c.state.Topology.GetNUMANodesForCPUs(cpus.List())
-				memStr := strings.Trim(strings.Join(strings.Fields(fmt.Sprint(mems)), ","), "[]")
-				err := c.cpusetController.UpdateCPUSet(cpuset.GetContainerInfo(container, *pod), cpus.String(), memStr)
-				if err != nil {
-					c.logger.Error(err, "Failed to update cpuset for container", "name", container.Name)
-					return
-				}
-				c.state.AddAllocation(containerInfo.ContainerID, plugin.Allocation{
-					CPUs: cpus.String(),
-					Type: allocationType,
-				})
-				c.logger.Info("STATE", "state", c.state)
+			if err := c.cpuView.Remove(cpuview.Key(resourceName, deviceIDs)); err != nil {
+				c.logger.Error(err, "Failed to remove cpu view files", "resource", resourceName, "devices", deviceIDs)
 			}
 		}
 	}
 }
 
 func (c *Controller) validatePod(pod *corev1.Pod) bool {
-	if pod.Spec.NodeName != os.Getenv("NODE_NAME") {
-		return false
-	}
-	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+	if pod.Spec.NodeName != c.nodeName {
 		return false
 	}
-	if len(pod.Status.ContainerStatuses) != len(pod.Spec.Containers) {
+	if isTerminalPhase(pod) {
 		return false
 	}
-	for _, container := range pod.Status.ContainerStatuses {
-		if container.ContainerID == "" {
-			return false
+	// Init containers run before the regular containers are created, so the pod is processed as soon as any
+	// container using the resources of the daemon has started.
+	for _, container := range allContainers(pod) {
+		if !isStarted(pod, container.Name) {
+			continue
 		}
-	}
-	for _, container := range pod.Spec.Containers {
-		for resourceName := range container.Resources.Requests {
-			if strings.Contains(resourceName.String(), plugin.Vendor) {
-				return true
-			}
+		if c.requestsManagedResources(container) {
+			return true
+		}
+		if c.claims != nil && len(container.Resources.Claims) > 0 {
+			return true
 		}
 	}
 	return false
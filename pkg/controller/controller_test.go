@@ -0,0 +1,726 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stefanaki/cpuset-plugin/pkg/controllertest"
+	"github.com/stefanaki/cpuset-plugin/pkg/cpuview"
+	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
+	"github.com/stefanaki/cpuset-plugin/pkg/topology"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1"
+	cpusetutils "k8s.io/utils/cpuset"
+)
+
+const (
+	testNodeName    = "node-1"
+	testContainerID = "containerd://benchmark-1"
+)
+
+// testController is a controller running against a fake clientset, cpuset applier and PodResources client.
+type testController struct {
+	*Controller
+	client       *fake.Clientset
+	state        *plugin.State
+	applier      *controllertest.CPUSetApplier
+	podResources *controllertest.PodResourcesClient
+	recorder     *record.FakeRecorder
+	stopCh       chan struct{}
+}
+
+func newTestController(t *testing.T, pods ...*corev1.Pod) *testController {
+	t.Helper()
+	state, err := plugin.NewState(logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create state: %v", err)
+	}
+	resources, err := plugin.ParseResourcesConfig(plugin.Vendor, "core,cpu")
+	if err != nil {
+		t.Fatalf("failed to parse resources: %v", err)
+	}
+	objects := make([]runtime.Object, 0, len(pods))
+	for _, pod := range pods {
+		objects = append(objects, pod)
+	}
+	tc := &testController{
+		client:       fake.NewSimpleClientset(objects...),
+		state:        state,
+		applier:      controllertest.NewCPUSetApplier(),
+		podResources: controllertest.NewPodResourcesClient(),
+		recorder:     record.NewFakeRecorder(100),
+		stopCh:       make(chan struct{}),
+	}
+	for _, pod := range pods {
+		tc.podResources.SetPod(podResourcesForCore(pod, "0"))
+	}
+	views, err := cpuview.NewGenerator(t.TempDir(), logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create cpu view generator: %v", err)
+	}
+	tc.Controller, err = NewController(Options{
+		NodeName:     testNodeName,
+		Client:       tc.client,
+		State:        state,
+		Resources:    resources,
+		CPUSet:       tc.applier,
+		PodResources: tc.podResources,
+		Recorder:     tc.recorder,
+		CPUView:      views,
+	}, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create controller: %v", err)
+	}
+	return tc
+}
+
+// run starts the controller with its workers and reconciliation loop.
+func (tc *testController) run(t *testing.T) {
+	t.Helper()
+	if err := tc.Run(1, &tc.stopCh); err != nil {
+		t.Fatalf("failed to run controller: %v", err)
+	}
+	t.Cleanup(tc.Stop)
+}
+
+// seed only syncs the informer and seeds the state, without starting the workers or the reconciliation loop,
+// so that reconcile can be called deterministically.
+func (tc *testController) seed(t *testing.T) {
+	t.Helper()
+	tc.Controller.stopCh = &tc.stopCh
+	t.Cleanup(tc.Stop)
+	tc.informerFactory.Start(tc.stopCh)
+	if !cache.WaitForCacheSync(tc.stopCh, tc.informer.HasSynced) {
+		t.Fatal("failed to sync informer")
+	}
+	if err := tc.seedState(); err != nil {
+		t.Fatalf("failed to seed state: %v", err)
+	}
+}
+
+// newPod returns a running pod of the node whose container requests a core.
+func newPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "benchmark", Namespace: "default", UID: "pod-uid-1"},
+		Spec: corev1.PodSpec{
+			NodeName: testNodeName,
+			Containers: []corev1.Container{{
+				Name:      "benchmark",
+				Resources: coreRequest(),
+			}},
+		},
+		Status: corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "benchmark", ContainerID: testContainerID}},
+		},
+	}
+}
+
+// coreRequest returns the resources of a container requesting a core.
+func coreRequest() corev1.ResourceRequirements {
+	return corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{plugin.Vendor + "/core": resource.MustParse("1")},
+		Limits:   corev1.ResourceList{plugin.Vendor + "/core": resource.MustParse("1")},
+	}
+}
+
+// addContainer adds a regular container to the pod, which has a container ID once started.
+func addContainer(pod *corev1.Pod, name string, resources corev1.ResourceRequirements, started bool) {
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name, Resources: resources})
+	status := corev1.ContainerStatus{Name: name}
+	if started {
+		status.ContainerID = "containerd://" + name
+	}
+	pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, status)
+}
+
+// addInitContainer adds an init container requesting a core to the pod, which runs once started.
+func addInitContainer(pod *corev1.Pod, name string, started bool) {
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{Name: name, Resources: coreRequest()})
+	status := corev1.ContainerStatus{Name: name}
+	if started {
+		status.ContainerID = "containerd://" + name
+		status.State.Running = &corev1.ContainerStateRunning{}
+	}
+	pod.Status.InitContainerStatuses = append(pod.Status.InitContainerStatuses, status)
+}
+
+// setStatus replaces the status of the container of any kind of the pod.
+func setStatus(pod *corev1.Pod, status corev1.ContainerStatus) {
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for i := range statuses {
+			if statuses[i].Name == status.Name {
+				statuses[i] = status
+			}
+		}
+	}
+}
+
+// podResourcesForCore returns the pod resources reported by the kubelet for a pod whose containers requesting a core hold it.
+func podResourcesForCore(pod *corev1.Pod, coreID string) *podresources.PodResources {
+	containers := make([]*podresources.ContainerResources, 0, len(pod.Spec.Containers))
+	for _, container := range allContainers(pod) {
+		containerResources := &podresources.ContainerResources{Name: container.Name}
+		if _, ok := container.Resources.Requests[plugin.Vendor+"/core"]; ok {
+			containerResources.Devices = []*podresources.ContainerDevices{{ResourceName: plugin.Vendor + "/core", DeviceIds: []string{coreID}}}
+		}
+		containers = append(containers, containerResources)
+	}
+	return &podresources.PodResources{Name: pod.Name, Namespace: pod.Namespace, Containers: containers}
+}
+
+// eventually polls condition until it holds, failing the test after a timeout.
+func eventually(t *testing.T, condition func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf(format, args...)
+}
+
+// isPinned reports whether the container was pinned to the CPUs.
+func (tc *testController) isPinned(containerID string, cpus cpusetutils.CPUSet) bool {
+	update, ok := tc.applier.CPUSet(containerID)
+	return ok && update.CPUs == cpus.String()
+}
+
+// waitForEvent waits until an Event with the reason is recorded.
+func (tc *testController) waitForEvent(t *testing.T, reason string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-tc.recorder.Events:
+			if strings.Contains(event, " "+reason+" ") {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no %s event was recorded", reason)
+		}
+	}
+}
+
+// recordedReasons returns the reasons of the Events recorded so far.
+func (tc *testController) recordedReasons() []string {
+	reasons := make([]string, 0)
+	for {
+		select {
+		case event := <-tc.recorder.Events:
+			reasons = append(reasons, strings.Fields(event)[1])
+		default:
+			return reasons
+		}
+	}
+}
+
+func TestPinContainer(t *testing.T) {
+	pod := newPod()
+	tc := newTestController(t, pod)
+	tc.run(t)
+
+	cpus := cpusetutils.New(tc.state.Topology.GetAllCPUsInCore(0)...)
+	eventually(t, func() bool { return tc.isPinned(testContainerID, cpus) }, "container was not pinned to %s", cpus.String())
+	update, _ := tc.applier.CPUSet(testContainerID)
+	if update.Mems != tc.memsForCPUs(cpus) {
+		t.Errorf("mems = %s, want %s", update.Mems, tc.memsForCPUs(cpus))
+	}
+	allocation, ok := tc.state.GetAllocation(plugin.ContainerKey(string(pod.UID), "benchmark"))
+	if !ok {
+		t.Fatal("container allocation is missing from the state")
+	}
+	if allocation.CPUs != cpus.String() || allocation.ContainerID != testContainerID {
+		t.Errorf("allocation = %+v, want cpus %s of container %s", allocation, cpus.String(), testContainerID)
+	}
+	tc.waitForEvent(t, EventReasonCPUSetApplied)
+}
+
+func TestRepinRestartedContainer(t *testing.T) {
+	pod := newPod()
+	tc := newTestController(t, pod)
+	tc.run(t)
+
+	cpus := cpusetutils.New(tc.state.Topology.GetAllCPUsInCore(0)...)
+	eventually(t, func() bool { return tc.isPinned(testContainerID, cpus) }, "container was not pinned")
+
+	restarted := pod.DeepCopy()
+	restarted.Status.ContainerStatuses[0].ContainerID = "containerd://benchmark-2"
+	restarted.Status.ContainerStatuses[0].RestartCount = 1
+	if _, err := tc.client.CoreV1().Pods(pod.Namespace).UpdateStatus(context.TODO(), restarted, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update pod: %v", err)
+	}
+	eventually(t, func() bool { return tc.isPinned("containerd://benchmark-2", cpus) }, "restarted container was not pinned")
+	eventually(t, func() bool {
+		allocation, ok := tc.state.GetAllocation(plugin.ContainerKey(string(pod.UID), "benchmark"))
+		return ok && allocation.ContainerID == "containerd://benchmark-2"
+	}, "allocation does not record the restarted container")
+}
+
+func TestDeletePod(t *testing.T) {
+	pod := newPod()
+	tc := newTestController(t, pod)
+	tc.run(t)
+
+	key := plugin.ContainerKey(string(pod.UID), "benchmark")
+	eventually(t, func() bool {
+		_, ok := tc.state.GetAllocation(key)
+		return ok
+	}, "container allocation was not recorded")
+
+	if err := tc.client.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete pod: %v", err)
+	}
+	eventually(t, func() bool {
+		_, ok := tc.state.GetAllocation(key)
+		return !ok
+	}, "allocation of deleted pod was not released")
+}
+
+func TestDeletePodTombstone(t *testing.T) {
+	pod := newPod()
+	tc := newTestController(t, pod)
+	tc.run(t)
+
+	key := plugin.ContainerKey(string(pod.UID), "benchmark")
+	eventually(t, func() bool {
+		_, ok := tc.state.GetAllocation(key)
+		return ok
+	}, "container allocation was not recorded")
+	eventually(t, func() bool {
+		current, err := tc.podLister.Pods(pod.Namespace).Get(pod.Name)
+		if err != nil {
+			return false
+		}
+		_, ok := current.Annotations[PlacementAnnotationKey(tc.resources.Domain, "benchmark")]
+		return ok
+	}, "pod was not annotated with its placement")
+
+	// A pod deleted while the watch was disconnected is removed from the store on relist, and delivered as a tombstone.
+	if err := tc.informer.GetStore().Delete(pod); err != nil {
+		t.Fatalf("failed to remove pod from the informer store: %v", err)
+	}
+	tc.handleDeletePod(cache.DeletedFinalStateUnknown{Key: "default/benchmark", Obj: pod})
+	eventually(t, func() bool {
+		_, ok := tc.state.GetAllocation(key)
+		return !ok
+	}, "allocation of the pod deleted through a tombstone was not released")
+}
+
+func TestRecreatePod(t *testing.T) {
+	pod := newPod()
+	tc := newTestController(t, pod)
+	tc.run(t)
+
+	key := plugin.ContainerKey(string(pod.UID), "benchmark")
+	eventually(t, func() bool {
+		_, ok := tc.state.GetAllocation(key)
+		return ok
+	}, "container allocation was not recorded")
+
+	// The pod is deleted and recreated with the same name, before the deletion is processed.
+	recreated := newPod()
+	recreated.UID = "pod-uid-2"
+	recreated.Status.ContainerStatuses[0].ContainerID = "containerd://benchmark-2"
+	if err := tc.client.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete pod: %v", err)
+	}
+	if _, err := tc.client.CoreV1().Pods(pod.Namespace).Create(context.TODO(), recreated, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create pod: %v", err)
+	}
+	eventually(t, func() bool {
+		_, released := tc.state.GetAllocation(key)
+		_, added := tc.state.GetAllocation(plugin.ContainerKey(string(recreated.UID), "benchmark"))
+		return !released && added
+	}, "allocation of the deleted pod was not replaced by the allocation of the recreated pod")
+}
+
+func TestSeedPendingPod(t *testing.T) {
+	// The kubelet allocated the devices of the container, which has not started yet.
+	pod := newPod()
+	pod.Status.Phase = corev1.PodPending
+	pod.Status.ContainerStatuses[0].ContainerID = ""
+	tc := newTestController(t, pod)
+	tc.seed(t)
+
+	if _, ok := tc.state.GetAllocation(plugin.ContainerKey(string(pod.UID), "benchmark")); ok {
+		t.Errorf("container that has not started has an allocation")
+	}
+	key := plugin.ReservationKey(plugin.Vendor+"/core", []string{"0"})
+	if _, ok := tc.state.GetReservations()[key]; !ok {
+		t.Fatalf("devices of the pending container were not reserved, reservations = %v", tc.state.GetReservations())
+	}
+	cpus := cpusetutils.New(tc.state.Topology.GetAllCPUsInCore(0)...)
+	err := tc.state.Reserve("other", plugin.Allocation{CPUs: cpus.String(), Type: plugin.AllocationTypeCPU})
+	if err == nil {
+		t.Errorf("reserved the cpus of the pending container through another resource")
+	}
+}
+
+func TestSeedPendingContainer(t *testing.T) {
+	// The kubelet allocated the devices of both containers of the pod, of which only one has started.
+	pod := newPod()
+	addContainer(pod, "metrics", coreRequest(), false)
+	tc := newTestController(t, pod)
+	tc.seed(t)
+
+	if _, ok := tc.state.GetAllocation(plugin.ContainerKey(string(pod.UID), "benchmark")); !ok {
+		t.Errorf("started container has no allocation")
+	}
+	if _, ok := tc.state.GetAllocation(plugin.ContainerKey(string(pod.UID), "metrics")); ok {
+		t.Errorf("container that has not started has an allocation")
+	}
+	key := plugin.ReservationKey(plugin.Vendor+"/core", []string{"0"})
+	if _, ok := tc.state.GetReservations()[key]; !ok {
+		t.Errorf("devices of the pending container were not reserved, reservations = %v", tc.state.GetReservations())
+	}
+}
+
+func TestHandOverInitContainerDevices(t *testing.T) {
+	// The kubelet reuses the core of the init container for the app container, and Allocate reserved it and wrote its
+	// cpu view files before any container started.
+	pod := newPod()
+	addInitContainer(pod, "setup", false)
+	setStatus(pod, corev1.ContainerStatus{Name: "benchmark"})
+	pod.Status.Phase = corev1.PodPending
+	tc := newTestController(t, pod)
+	tc.seed(t)
+	cpus := cpusetutils.New(tc.state.Topology.GetAllCPUsInCore(0)...)
+	view := cpuview.Key(plugin.Vendor+"/core", []string{"0"})
+	if _, err := tc.cpuView.Write(view, cpus); err != nil {
+		t.Fatalf("failed to write cpu view files: %v", err)
+	}
+
+	setStatus(pod, corev1.ContainerStatus{Name: "setup", ContainerID: "containerd://setup", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}})
+	if err := tc.handlePod(pod); err != nil {
+		t.Fatalf("failed to pin init container: %v", err)
+	}
+	if !tc.isPinned("containerd://setup", cpus) {
+		t.Fatalf("init container was not pinned to %s", cpus.String())
+	}
+
+	// The init container completed while the app container has not started yet.
+	setStatus(pod, corev1.ContainerStatus{Name: "setup", ContainerID: "containerd://setup", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}})
+	if err := tc.handlePod(pod); err != nil {
+		t.Fatalf("failed to release init container: %v", err)
+	}
+	if _, ok := tc.state.GetAllocation(plugin.ContainerKey(string(pod.UID), "setup")); ok {
+		t.Errorf("completed init container still holds its allocation")
+	}
+	if !tc.cpuView.Exists(view) {
+		t.Errorf("cpu view files of the devices handed to the app container were removed")
+	}
+	if err := tc.state.Reserve("other", plugin.Allocation{CPUs: cpus.String(), Type: plugin.AllocationTypeCPU}); err == nil {
+		t.Errorf("reserved the cpus handed to the app container before it was pinned")
+	}
+
+	setStatus(pod, corev1.ContainerStatus{Name: "benchmark", ContainerID: testContainerID})
+	if err := tc.handlePod(pod); err != nil {
+		t.Fatalf("failed to pin app container: %v", err)
+	}
+	if !tc.isPinned(testContainerID, cpus) {
+		t.Errorf("app container was not pinned to %s", cpus.String())
+	}
+	if !tc.cpuView.Exists(view) {
+		t.Errorf("cpu view files of the app container were removed")
+	}
+}
+
+func TestCPURequestMismatch(t *testing.T) {
+	pod := newPod()
+	tc := newTestController(t, pod)
+	tc.seed(t)
+	cpus := cpusetutils.New(tc.state.Topology.GetAllCPUsInCore(0)...)
+
+	// The container sets no cpu request, so there is nothing to compare with its CPUs.
+	if reasons := tc.recordedReasons(); len(reasons) != 1 || reasons[0] != EventReasonCPUSetApplied {
+		t.Errorf("recorded events %v, want only %s", reasons, EventReasonCPUSetApplied)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		request  string
+		mismatch bool
+	}{
+		{name: "matching", request: strconv.Itoa(cpus.Size())},
+		{name: "mismatching", request: strconv.Itoa(cpus.Size() + 1), mismatch: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			container := pod.Spec.Containers[0]
+			container.Resources = coreRequest()
+			container.Resources.Requests[corev1.ResourceCPU] = resource.MustParse(tt.request)
+			tc.recordApplied(pod, container, cpus, tc.memsForCPUs(cpus), plugin.Allocation{Type: plugin.AllocationTypeCore}, true)
+			reasons := tc.recordedReasons()
+			if mismatch := len(reasons) == 2 && reasons[1] == EventReasonCPURequestMismatch; mismatch != tt.mismatch {
+				t.Errorf("recorded events %v for a cpu request of %s on %d CPUs", reasons, tt.request, cpus.Size())
+			}
+		})
+	}
+}
+
+func TestPodScope(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		containers string
+		pinned     map[string]bool
+	}{
+		{name: "all containers", pinned: map[string]bool{testContainerID: true, "containerd://metrics": true}},
+		{name: "selected containers", containers: "benchmark", pinned: map[string]bool{testContainerID: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// Only the main container requests a core, which the metrics sidecar shares.
+			pod := newPod()
+			addContainer(pod, "metrics", corev1.ResourceRequirements{}, true)
+			pod.Annotations = map[string]string{plugin.Vendor + "/" + annotationPodScope: "true"}
+			if tt.containers != "" {
+				pod.Annotations[plugin.Vendor+"/"+annotationPodScopeContainers] = tt.containers
+			}
+			tc := newTestController(t, pod)
+			tc.seed(t)
+			cpus := cpusetutils.New(tc.state.Topology.GetAllCPUsInCore(0)...)
+
+			for _, containerID := range []string{testContainerID, "containerd://metrics"} {
+				if pinned := tc.isPinned(containerID, cpus); pinned != tt.pinned[containerID] {
+					t.Errorf("container %s pinned = %v, want %v", containerID, pinned, tt.pinned[containerID])
+				}
+			}
+
+			// The pod-wide set is accounted for once, along with the devices of every container.
+			allocations := tc.state.GetAllocations()
+			if len(allocations) != 1 {
+				t.Fatalf("allocations = %v, want only the pod-wide allocation", allocations)
+			}
+			allocation, ok := allocations[podAllocationKey(pod)]
+			if !ok || allocation.CPUs != cpus.String() {
+				t.Fatalf("pod-wide allocation = %+v, %v, want cpus %s", allocation, ok, cpus.String())
+			}
+			if devices := allocation.ContainerDevices["benchmark"][plugin.Vendor+"/core"]; len(devices) != 1 || devices[0] != "0" {
+				t.Errorf("devices of container benchmark = %v, want core 0", allocation.ContainerDevices)
+			}
+			if len(tc.state.GetReservations()) != 0 {
+				t.Errorf("reservations = %v, want none once the pod is pinned", tc.state.GetReservations())
+			}
+
+			tc.deletePod(pod)
+			if _, ok := tc.state.GetAllocation(podAllocationKey(pod)); ok {
+				t.Errorf("pod-wide allocation was not released with the pod")
+			}
+		})
+	}
+}
+
+func TestReleaseTerminatedContainer(t *testing.T) {
+	always := corev1.ContainerRestartPolicyAlways
+	for _, tt := range []struct {
+		name              string
+		restartPolicy     corev1.RestartPolicy
+		initContainer     bool
+		sidecar           bool
+		exitCode          int32
+		releaseTerminated bool
+		released          bool
+	}{
+		{name: "completed step", restartPolicy: corev1.RestartPolicyNever, releaseTerminated: true, released: true},
+		{name: "release disabled", restartPolicy: corev1.RestartPolicyNever},
+		{name: "restarted always", restartPolicy: corev1.RestartPolicyAlways, releaseTerminated: true},
+		{name: "failed step restarted on failure", restartPolicy: corev1.RestartPolicyOnFailure, exitCode: 1, releaseTerminated: true},
+		{name: "succeeded step not restarted on failure", restartPolicy: corev1.RestartPolicyOnFailure, releaseTerminated: true, released: true},
+		{name: "completed init container", restartPolicy: corev1.RestartPolicyAlways, initContainer: true, released: true},
+		{name: "terminated sidecar", restartPolicy: corev1.RestartPolicyNever, initContainer: true, sidecar: true, releaseTerminated: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// The step terminates while the main container of the pod keeps running.
+			pod := newPod()
+			pod.Spec.RestartPolicy = tt.restartPolicy
+			if tt.initContainer {
+				addInitContainer(pod, "step", true)
+				if tt.sidecar {
+					pod.Spec.InitContainers[0].RestartPolicy = &always
+				}
+			} else {
+				addContainer(pod, "step", coreRequest(), true)
+			}
+			tc := newTestController(t, pod)
+			tc.releaseTerminated = tt.releaseTerminated
+			tc.seed(t)
+			key := plugin.ContainerKey(string(pod.UID), "step")
+			if _, ok := tc.state.GetAllocation(key); !ok {
+				t.Fatal("running step has no allocation")
+			}
+
+			setStatus(pod, corev1.ContainerStatus{
+				Name:        "step",
+				ContainerID: "containerd://step",
+				State:       corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: tt.exitCode}},
+			})
+			if err := tc.handlePod(pod); err != nil {
+				t.Fatalf("failed to handle pod: %v", err)
+			}
+			if _, ok := tc.state.GetAllocation(key); ok == tt.released {
+				t.Errorf("terminated step holds its allocation = %v, want %v", ok, !tt.released)
+			}
+			if _, ok := tc.state.GetAllocation(plugin.ContainerKey(string(pod.UID), "benchmark")); !ok {
+				t.Errorf("running container lost its allocation")
+			}
+		})
+	}
+}
+
+// placement returns the placement annotation of a container on the pod stored by the API server.
+func (tc *testController) placement(t *testing.T, pod *corev1.Pod, containerName string) (*corev1.Pod, Placement) {
+	t.Helper()
+	stored, err := tc.client.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get pod: %v", err)
+	}
+	value, ok := stored.Annotations[PlacementAnnotationKey(plugin.Vendor, containerName)]
+	if !ok {
+		t.Fatalf("pod has no placement annotation for container %s", containerName)
+	}
+	var placement Placement
+	if err := json.Unmarshal([]byte(value), &placement); err != nil {
+		t.Fatalf("invalid placement annotation %q: %v", value, err)
+	}
+	return stored, placement
+}
+
+func TestPlacementAnnotations(t *testing.T) {
+	pod := newPod()
+	pod.Spec.RestartPolicy = corev1.RestartPolicyNever
+	addContainer(pod, "step", coreRequest(), true)
+	tc := newTestController(t, pod)
+	tc.releaseTerminated = true
+	tc.seed(t)
+	cpus := cpusetutils.New(tc.state.Topology.GetAllCPUsInCore(0)...)
+
+	_, placement := tc.placement(t, pod, "benchmark")
+	want := Placement{
+		ContainerID:    testContainerID,
+		CPUs:           cpus.String(),
+		Mems:           tc.memsForCPUs(cpus),
+		AllocationType: plugin.AllocationTypeCore,
+		Devices:        map[string][]string{plugin.Vendor + "/core": {"0"}},
+	}
+	if !reflect.DeepEqual(placement, want) {
+		t.Errorf("placement = %+v, want %+v", placement, want)
+	}
+
+	// The main container restarts while the step completes.
+	stored, _ := tc.placement(t, pod, "step")
+	setStatus(stored, corev1.ContainerStatus{Name: "benchmark", ContainerID: "containerd://benchmark-2"})
+	setStatus(stored, corev1.ContainerStatus{
+		Name:        "step",
+		ContainerID: "containerd://step",
+		State:       corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}},
+	})
+	if err := tc.handlePod(stored); err != nil {
+		t.Fatalf("failed to handle pod: %v", err)
+	}
+	if _, placement := tc.placement(t, pod, "benchmark"); placement.ContainerID != "containerd://benchmark-2" || placement.Stale {
+		t.Errorf("placement of the restarted container = %+v, want container ID containerd://benchmark-2", placement)
+	}
+	if _, placement := tc.placement(t, pod, "step"); !placement.Stale || placement.CPUs != cpus.String() {
+		t.Errorf("placement of the released container = %+v, want stale on cpus %s", placement, cpus.String())
+	}
+}
+
+func TestMemsForCPUs(t *testing.T) {
+	tc := newTestController(t)
+	// A CPU per NUMA node, listed in a map so that the nodes are iterated in random order.
+	nodes := make(map[int]topology.NUMANode)
+	for _, node := range []int{0, 2, 3, 5} {
+		nodes[node] = topology.NUMANode{CPUs: cpusetutils.New(node), CPUStr: strconv.Itoa(node)}
+	}
+	tc.state.Topology = &topology.Topology{NUMATopology: topology.NUMATopology{Nodes: nodes}}
+
+	for i := 0; i < 20; i++ {
+		if mems := tc.memsForCPUs(cpusetutils.New(0, 2, 3, 5)); mems != "0,2-3,5" {
+			t.Fatalf("mems = %s, want 0,2-3,5", mems)
+		}
+	}
+}
+
+func TestReconcileDrift(t *testing.T) {
+	pod := newPod()
+	tc := newTestController(t, pod)
+	tc.seed(t)
+
+	cpus := cpusetutils.New(tc.state.Topology.GetAllCPUsInCore(0)...)
+	if !tc.isPinned(testContainerID, cpus) {
+		t.Fatalf("container was not pinned when seeding the state")
+	}
+
+	// The same cpuset written in another format has not drifted.
+	ids := make([]string, 0, cpus.Size())
+	for _, cpu := range cpus.List() {
+		ids = append(ids, cpusetutils.New(cpu).String())
+	}
+	tc.applier.SetCPUSet(testContainerID, strings.Join(ids, ","), tc.memsForCPUs(cpus))
+	report, err := tc.reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if !report.isEmpty() {
+		t.Errorf("reconcile report = %+v, want nothing to fix", report)
+	}
+
+	tc.applier.SetCPUSet(testContainerID, "", "")
+	report, err = tc.reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if want := "default/benchmark/benchmark"; len(report.Repinned) != 1 || report.Repinned[0] != want {
+		t.Errorf("repinned = %v, want [%s]", report.Repinned, want)
+	}
+	if !tc.isPinned(testContainerID, cpus) {
+		t.Errorf("drifted container was not pinned again")
+	}
+
+	tc.podResources.RemovePod(pod.Namespace, pod.Name)
+	report, err = tc.reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if want := plugin.ContainerKey(string(pod.UID), "benchmark"); len(report.Dropped) != 1 || report.Dropped[0] != want {
+		t.Errorf("dropped = %v, want [%s]", report.Dropped, want)
+	}
+}
+
+func TestRetryFailedPod(t *testing.T) {
+	pod := newPod()
+	tc := newTestController(t, pod)
+	tc.applier.SetErr(errors.New("cgroup is busy"))
+	tc.run(t)
+
+	tc.waitForEvent(t, EventReasonCPUSetFailed)
+	tc.applier.SetErr(nil)
+	cpus := cpusetutils.New(tc.state.Topology.GetAllCPUsInCore(0)...)
+	eventually(t, func() bool { return tc.isPinned(testContainerID, cpus) }, "failed pod was not retried")
+}
+
+func TestGiveUpOnFailedPod(t *testing.T) {
+	pod := newPod()
+	tc := newTestController(t, pod)
+	tc.applier.SetErr(errors.New("cgroup is busy"))
+	tc.run(t)
+
+	tc.waitForEvent(t, EventReasonSyncFailed)
+	if tc.queue.Len() != 0 {
+		t.Errorf("pod is still queued after the controller gave up on it")
+	}
+}
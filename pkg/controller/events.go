@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"github.com/stefanaki/cpuset-plugin/pkg/cpuset"
+	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	cpusetutils "k8s.io/utils/cpuset"
+)
+
+// eventSourceComponent is the component reported as the source of the Events recorded by the controller.
+const eventSourceComponent = "cpuset-device-plugin"
+
+// Reasons of the Events recorded on the pods.
+const (
+	// EventReasonCPUSetApplied is recorded when the cpuset of a container is applied.
+	EventReasonCPUSetApplied = "CPUSetApplied"
+	// EventReasonCPUSetFailed is recorded when the cpuset of a container cannot be applied.
+	EventReasonCPUSetFailed = "CPUSetFailed"
+	// EventReasonCPURequestMismatch is recorded when the cpu request of a container differs from its exclusive CPUs.
+	EventReasonCPURequestMismatch = "CPURequestMismatch"
+	// EventReasonSyncFailed is recorded when the controller gives up on a pod after maxRetries failures.
+	EventReasonSyncFailed = "CPUSetSyncFailed"
+)
+
+// newEventRecorder creates an EventRecorder writing the Events of the node through the client.
+func newEventRecorder(client kubernetes.Interface, nodeName string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventSourceComponent, Host: nodeName})
+}
+
+// recordApplied records the cpuset applied to a container, and warns if the cpu request of the container
+// does not match the exclusive CPUs it received. Containers that set no cpu request nor limit are not compared.
+func (c *Controller) recordApplied(pod *corev1.Pod, container corev1.Container, cpus cpusetutils.CPUSet, mems string, allocation plugin.Allocation, exclusive bool) {
+	allocationType := allocation.Type
+	if allocationType == "" {
+		allocationType = plugin.AllocationTypeClaim
+	}
+	c.recorder.Eventf(pod, corev1.EventTypeNormal, EventReasonCPUSetApplied,
+		"Applied cpuset to container %s: cpus %s, mems %s, allocation type %s", container.Name, cpus.String(), mems, allocationType)
+
+	if !exclusive {
+		return
+	}
+	request := container.Resources.Requests.Cpu()
+	if request.IsZero() {
+		request = container.Resources.Limits.Cpu()
+	}
+	if request.IsZero() {
+		return
+	}
+	if request.MilliValue() != int64(cpus.Size())*1000 {
+		c.recorder.Eventf(pod, corev1.EventTypeWarning, EventReasonCPURequestMismatch,
+			"Container %s requests %s cpu but received %d exclusive CPUs (%s)", container.Name, request.String(), cpus.Size(), cpus.String())
+	}
+}
+
+// recordFailed records the failure to apply the cpuset of a container.
+func (c *Controller) recordFailed(pod *corev1.Pod, containerName string, err error) {
+	c.recorder.Eventf(pod, corev1.EventTypeWarning, EventReasonCPUSetFailed,
+		"Failed to apply cpuset to container %s: %v", containerName, err)
+}
+
+// recordGaveUp records the final failure to process the pod with the given namespace/name key.
+// The pod is resolved from the key, since the worker only holds the key.
+func (c *Controller) recordGaveUp(key string, err error) {
+	namespace, name, splitErr := cache.SplitMetaNamespaceKey(key)
+	if splitErr != nil {
+		return
+	}
+	pod, getErr := c.podLister.Pods(namespace).Get(name)
+	if getErr != nil {
+		// The pod is gone, there is nothing to record the Event on.
+		return
+	}
+	c.recorder.Eventf(pod, corev1.EventTypeWarning, EventReasonSyncFailed,
+		"Gave up applying the cpusets of the pod after %d retries: %v", maxRetries, err)
+}
+
+// isExclusive reports whether all the devices of the allocation are allocated exclusively to the container.
+func (c *Controller) isExclusive(allocation plugin.Allocation) bool {
+	for resourceName := range allocation.Devices {
+		resource, ok := c.resources.Lookup(resourceName)
+		if !ok || !resource.IsExclusive() {
+			return false
+		}
+	}
+	return true
+}
+
+// cpusetChanged reports whether the cpuset of a container differs from the one it was last applied, so that
+// Events are only recorded when the placement of the container changes. It must be called before the allocation is stored.
+func (c *Controller) cpusetChanged(key string, containerInfo cpuset.ContainerInfo, allocation plugin.Allocation, cpus cpusetutils.CPUSet, mems string) bool {
+	if allocation.CPUs != "" {
+		previous, ok := c.state.GetAllocation(key)
+		return !ok || previous.ContainerID != containerInfo.ContainerID || previous.CPUs != allocation.CPUs
+	}
+	// The containers using only resource claims have no allocation, their cgroup is compared instead.
+	currentCPUs, currentMems, err := c.cpusetController.GetCPUSet(containerInfo)
+	if err != nil {
+		return true
+	}
+	return !sameCPUList(currentCPUs, cpus.String()) || !sameCPUList(currentMems, mems)
+}
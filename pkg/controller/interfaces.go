@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"context"
+	"net"
+
+	"github.com/stefanaki/cpuset-plugin/pkg/cpuset"
+	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
+	"github.com/stefanaki/cpuset-plugin/pkg/topology"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// CPUSetApplier applies cpusets to the cgroups of containers, e.g. the cpuset.CPUSetController.
+type CPUSetApplier interface {
+	UpdateCPUSet(container cpuset.ContainerInfo, cpus, mems string) error
+	GetCPUSet(container cpuset.ContainerInfo) (cpus string, mems string, err error)
+}
+
+// StateStore stores the allocations and reservations of the CPUs, e.g. the plugin.State shared with the device plugins.
+type StateStore interface {
+	GetTopology() *topology.Topology
+	GetAllocation(key string) (plugin.Allocation, bool)
+	GetAllocations() map[string]plugin.Allocation
+	AddAllocation(key string, allocation plugin.Allocation)
+	RemoveAllocation(key string)
+	GetReservations() map[string]plugin.Reservation
+	Reserve(key string, allocation plugin.Allocation) error
+	ReleaseReservation(key string)
+}
+
+var (
+	_ CPUSetApplier = &cpuset.CPUSetController{}
+	_ StateStore    = &plugin.State{}
+)
+
+// NewPodResourcesClient connects to the kubelet PodResources service on the socket.
+// The returned connection must be closed by the caller once the controller is stopped.
+func NewPodResourcesClient(socket string) (podresources.PodResourcesListerClient, *grpc.ClientConn, error) {
+	conn, err := grpc.Dial(socket, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			d := &net.Dialer{}
+			return d.DialContext(ctx, "unix", addr)
+		}))
+	if err != nil {
+		return nil, nil, err
+	}
+	return podresources.NewPodResourcesListerClient(conn), conn, nil
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stefanaki/cpuset-plugin/pkg/controllertest"
+	"github.com/stefanaki/cpuset-plugin/pkg/kubelettest"
+	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1"
+	cpusetutils "k8s.io/utils/cpuset"
+)
+
+// newKubeletController creates a controller whose PodResources client is connected over gRPC to a fake kubelet
+// PodResources service, and returns the controller, the service and the cpuset applier.
+func newKubeletController(t *testing.T, server *kubelettest.PodResourcesServer, pods ...*corev1.Pod) (*Controller, *controllertest.CPUSetApplier) {
+	t.Helper()
+	state, err := plugin.NewState(logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create state: %v", err)
+	}
+	resources, err := plugin.ParseResourcesConfig(plugin.Vendor, "core,cpu")
+	if err != nil {
+		t.Fatalf("failed to parse resources: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start PodResources service: %v", err)
+	}
+	t.Cleanup(server.Stop)
+	client, conn, err := NewPodResourcesClient(server.Socket())
+	if err != nil {
+		t.Fatalf("failed to connect to PodResources service: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	clientset := fake.NewSimpleClientset()
+	for _, pod := range pods {
+		clientset.Tracker().Add(pod)
+		server.SetPod(podResourcesForCore(pod, "0"))
+	}
+	applier := controllertest.NewCPUSetApplier()
+	controller, err := NewController(Options{
+		NodeName:     testNodeName,
+		Client:       clientset,
+		State:        state,
+		Resources:    resources,
+		CPUSet:       applier,
+		PodResources: client,
+		Recorder:     record.NewFakeRecorder(100),
+	}, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create controller: %v", err)
+	}
+	stopCh := make(chan struct{})
+	if err := controller.Run(1, &stopCh); err != nil {
+		t.Fatalf("failed to run controller: %v", err)
+	}
+	t.Cleanup(controller.Stop)
+	return controller, applier
+}
+
+func TestPodResourcesClient(t *testing.T) {
+	server := kubelettest.NewPodResourcesServer(filepath.Join(t.TempDir(), "kubelet.sock"))
+	server.SetAllocatable(&podresources.AllocatableResourcesResponse{
+		Devices: []*podresources.ContainerDevices{{ResourceName: plugin.Vendor + "/core", DeviceIds: []string{"0"}}},
+	})
+	pod := newPod()
+	controller, applier := newKubeletController(t, server, pod)
+
+	// The running pod is pinned from the devices listed by the kubelet when the state is seeded.
+	cpus := cpusetutils.New(controller.state.GetTopology().GetAllCPUsInCore(0)...)
+	if update, ok := applier.CPUSet(testContainerID); !ok || update.CPUs != cpus.String() {
+		t.Fatalf("container was not pinned to %s when seeding the state", cpus.String())
+	}
+
+	response, err := controller.getPodResources(pod)
+	if err != nil {
+		t.Fatalf("failed to get pod resources: %v", err)
+	}
+	if devices := containerDevices(response.GetContainers()[0]); len(devices[plugin.Vendor+"/core"]) != 1 {
+		t.Errorf("pod resources devices = %v, want core 0", devices)
+	}
+	other := newPod()
+	other.Name = "other"
+	if _, err := controller.getPodResources(other); err == nil {
+		t.Errorf("got the resources of a pod unknown to the kubelet")
+	}
+}
+
+func TestPodResourcesClientWithoutGet(t *testing.T) {
+	server := kubelettest.NewPodResourcesServer(filepath.Join(t.TempDir(), "kubelet.sock"))
+	server.GetDisabled = true
+	server.AllocatableDisabled = true
+	pod := newPod()
+	controller, _ := newKubeletController(t, server, pod)
+
+	// The pod is looked up with List when Get is disabled.
+	response, err := controller.getPodResources(pod)
+	if err != nil {
+		t.Fatalf("failed to get pod resources through List: %v", err)
+	}
+	if response.GetName() != pod.Name {
+		t.Errorf("pod resources of %s, want %s", response.GetName(), pod.Name)
+	}
+}
+
+func TestPodResourcesClientUnavailable(t *testing.T) {
+	server := kubelettest.NewPodResourcesServer(filepath.Join(t.TempDir(), "kubelet.sock"))
+	controller, _ := newKubeletController(t, server)
+
+	server.Stop()
+	if _, err := controller.reconcile(); err == nil {
+		t.Errorf("reconcile succeeded while the kubelet PodResources service is down")
+	}
+	if _, err := controller.getPodResources(newPod()); err == nil {
+		t.Errorf("got pod resources while the kubelet PodResources service is down")
+	}
+	if _, err := controller.podResourcesClient.List(context.TODO(), &podresources.ListPodResourcesRequest{}); err == nil {
+		t.Errorf("listed pod resources while the kubelet PodResources service is down")
+	}
+}
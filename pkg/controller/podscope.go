@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stefanaki/cpuset-plugin/pkg/cpuset"
+	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
+	corev1 "k8s.io/api/core/v1"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1"
+	cpusetutils "k8s.io/utils/cpuset"
+)
+
+// Annotations enabling the pod-scoped allocation mode, prefixed with the resource domain,
+// e.g. stefanaki.github.com/pod-scope: "true".
+const (
+	// annotationPodScope makes the devices requested by all the containers of the pod a single pod-wide exclusive set.
+	annotationPodScope = "pod-scope"
+	// annotationPodScopeContainers is the comma separated list of the containers pinned to the pod-wide set.
+	// All the regular and sidecar containers of the pod are pinned when it is not set.
+	annotationPodScopeContainers = "pod-scope-containers"
+)
+
+// podScopeContainers returns the names of the containers pinned to the pod-wide set,
+// or nil if the pod does not use the pod-scoped allocation mode.
+func (c *Controller) podScopeContainers(pod *corev1.Pod) map[string]struct{} {
+	if pod.Annotations[c.resources.Domain+"/"+annotationPodScope] != "true" {
+		return nil
+	}
+	containers := make(map[string]struct{})
+	selected, ok := pod.Annotations[c.resources.Domain+"/"+annotationPodScopeContainers]
+	if !ok {
+		for _, container := range pod.Spec.Containers {
+			containers[container.Name] = struct{}{}
+		}
+		for _, container := range pod.Spec.InitContainers {
+			if container.RestartPolicy != nil && *container.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+				containers[container.Name] = struct{}{}
+			}
+		}
+		return containers
+	}
+	for _, name := range strings.Split(selected, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			containers[name] = struct{}{}
+		}
+	}
+	return containers
+}
+
+// podAllocationKeyPrefix prefixes the keys of the pod-wide allocations in the state.
+const podAllocationKeyPrefix = "pod://"
+
+// podAllocationKey returns the key of the pod-wide allocation in the state.
+func podAllocationKey(pod *corev1.Pod) string {
+	return podAllocationKeyPrefix + string(pod.UID)
+}
+
+// handlePodScope pins the selected containers of the pod to the union of the devices of all its containers,
+// and accounts for them once in the state.
+func (c *Controller) handlePodScope(pod *corev1.Pod, podResources *podresources.PodResources, containers map[string]struct{}) error {
+	devices := make(map[string][]string)
+	podContainerDevices := make(map[string]map[string][]string)
+	for _, containerResources := range podResources.GetContainers() {
+		podContainerDevices[containerResources.GetName()] = containerDevices(containerResources)
+		for resourceName, deviceIDs := range podContainerDevices[containerResources.GetName()] {
+			devices[resourceName] = append(devices[resourceName], deviceIDs...)
+		}
+	}
+	allocation, err := c.resources.AllocationForDevices(c.state.GetTopology(), devices)
+	if err != nil {
+		c.logger.Error(err, "Failed to get CPUs of pod devices", "name", pod.Name)
+		return nil
+	}
+	if allocation.CPUs == "" {
+		return nil
+	}
+
+	cpus, _ := cpusetutils.Parse(allocation.CPUs)
+	mems := c.memsForCPUs(cpus)
+	previous, ok := c.state.GetAllocation(podAllocationKey(pod))
+	changed := !ok || previous.CPUs != allocation.CPUs
+	for _, container := range allContainers(pod) {
+		if _, ok := containers[container.Name]; !ok || !isStarted(pod, container.Name) {
+			continue
+		}
+		containerInfo := cpuset.GetContainerInfo(container, *pod)
+		if err := c.cpusetController.UpdateCPUSet(containerInfo, allocation.CPUs, mems); err != nil {
+			c.recordFailed(pod, container.Name, err)
+			return fmt.Errorf("failed to update cpuset for container %s: %v", container.Name, err)
+		}
+		// The pod-wide set is shared by the containers, so their cpu requests are not compared with it.
+		if changed {
+			c.recordApplied(pod, container, cpus, mems, allocation, false)
+		}
+		c.annotatePlacement(pod, container.Name, newPlacement(containerInfo.ContainerID, allocation.CPUs, mems, allocation))
+	}
+
+	// The devices were allocated, and their CPUs reserved, separately for every container.
+	allocation.ContainerDevices = podContainerDevices
+	for _, devices := range podContainerDevices {
+		c.updateCPUViews(devices, cpus)
+		for resourceName, deviceIDs := range devices {
+			c.state.ReleaseReservation(plugin.ReservationKey(resourceName, deviceIDs))
+		}
+	}
+	c.state.AddAllocation(podAllocationKey(pod), allocation)
+	c.logger.Info("Applied pod-wide cpuset", "name", pod.Name, "cpus", allocation.CPUs, "mems", mems)
+	return nil
+}
@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stefanaki/cpuset-plugin/pkg/cpuset"
+	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
+	corev1 "k8s.io/api/core/v1"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1"
+	cpusetutils "k8s.io/utils/cpuset"
+)
+
+// reconcileInterval is the interval between two reconciliation passes.
+const reconcileInterval = 5 * time.Second
+
+// reservationGracePeriod is how long a reservation made by Allocate may wait for its container to be pinned,
+// before it is considered leaked by a pod that never started and is released.
+const reservationGracePeriod = time.Minute
+
+// ReconcileReport lists what a reconciliation pass fixed.
+type ReconcileReport struct {
+	// Repinned lists the containers whose cgroup cpuset had drifted from their allocation.
+	Repinned []string
+	// Dropped lists the allocations of pods or containers that no longer exist.
+	Dropped []string
+	// Adopted lists the containers holding devices that were missing from the state.
+	Adopted []string
+	// ReleasedReservations lists the reservations of devices that were never assigned to a container.
+	ReleasedReservations []string
+}
+
+func (r ReconcileReport) isEmpty() bool {
+	return len(r.Repinned) == 0 && len(r.Dropped) == 0 && len(r.Adopted) == 0 && len(r.ReleasedReservations) == 0
+}
+
+// reconcile compares the allocations of the state with the pods run by the kubelet and with the cpusets of their cgroups,
+// and fixes any difference.
+func (c *Controller) reconcile() (ReconcileReport, error) {
+	report := ReconcileReport{}
+
+	list, err := c.podResourcesClient.List(context.TODO(), &podresources.ListPodResourcesRequest{})
+	if err != nil {
+		return report, fmt.Errorf("failed to list pod resources: %v", err)
+	}
+	kubeletPods := make(map[string]*podresources.PodResources)
+	assignedDevices := make(map[string]struct{})
+	for _, podResources := range list.GetPodResources() {
+		kubeletPods[podResources.GetNamespace()+"/"+podResources.GetName()] = podResources
+		for _, containerResources := range podResources.GetContainers() {
+			for resourceName, deviceIDs := range containerDevices(containerResources) {
+				assignedDevices[plugin.ReservationKey(resourceName, deviceIDs)] = struct{}{}
+			}
+		}
+	}
+
+	// The pods of the node that the kubelet still runs, keyed by UID.
+	pods := make(map[string]*corev1.Pod)
+	for _, obj := range c.informer.GetStore().List() {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || pod.Spec.NodeName != c.nodeName {
+			continue
+		}
+		if _, ok := kubeletPods[pod.Namespace+"/"+pod.Name]; ok {
+			pods[string(pod.UID)] = pod
+		}
+	}
+
+	for key, allocation := range c.state.GetAllocations() {
+		podUID, containerName, isContainer := plugin.ParseContainerKey(key)
+		isPodScope := strings.HasPrefix(key, podAllocationKeyPrefix)
+		if isPodScope {
+			podUID = strings.TrimPrefix(key, podAllocationKeyPrefix)
+		}
+		if !isContainer && !isPodScope {
+			continue
+		}
+
+		pod, ok := pods[podUID]
+		if ok && isContainer {
+			_, ok = podContainer(pod, containerName)
+			ok = ok && !c.isReleased(pod, containerName)
+		}
+		if !ok {
+			if pod, found := pods[podUID]; found && isContainer {
+				c.releaseContainer(pod, kubeletPods[pod.Namespace+"/"+pod.Name], containerName)
+				c.markPlacementStale(pod, containerName)
+			} else {
+				c.releaseAllocation(key)
+			}
+			report.Dropped = append(report.Dropped, key)
+			continue
+		}
+
+		cpus, _ := cpusetutils.Parse(allocation.CPUs)
+		if isContainer {
+			container, _ := podContainer(pod, containerName)
+			claimCPUs, _ := c.claimCPUs(pod, container)
+			if c.repinIfDrifted(cpuset.GetContainerInfo(container, *pod), cpus.Union(claimCPUs)) {
+				report.Repinned = append(report.Repinned, fmt.Sprintf("%s/%s/%s", pod.Namespace, pod.Name, containerName))
+			}
+			continue
+		}
+		for name := range c.podScopeContainers(pod) {
+			container, ok := podContainer(pod, name)
+			if !ok {
+				continue
+			}
+			if c.repinIfDrifted(cpuset.GetContainerInfo(container, *pod), cpus) {
+				report.Repinned = append(report.Repinned, fmt.Sprintf("%s/%s/%s", pod.Namespace, pod.Name, name))
+			}
+		}
+	}
+
+	allocations := c.state.GetAllocations()
+	for _, pod := range pods {
+		if !c.validatePod(pod) {
+			continue
+		}
+		adopted := c.missingContainers(pod, kubeletPods[pod.Namespace+"/"+pod.Name], allocations)
+		if len(adopted) == 0 {
+			continue
+		}
+		for _, name := range adopted {
+			report.Adopted = append(report.Adopted, fmt.Sprintf("%s/%s/%s", pod.Namespace, pod.Name, name))
+		}
+		c.enqueuePod(pod)
+	}
+
+	for key, reservation := range c.state.GetReservations() {
+		if time.Since(reservation.CreatedAt) < reservationGracePeriod {
+			continue
+		}
+		if _, ok := assignedDevices[key]; ok {
+			continue
+		}
+		c.state.ReleaseReservation(key)
+		report.ReleasedReservations = append(report.ReleasedReservations, key)
+	}
+
+	return report, nil
+}
+
+// missingContainers returns the names of the containers of the pod that hold devices according to the kubelet,
+// but have no allocation in the state.
+func (c *Controller) missingContainers(pod *corev1.Pod, podResources *podresources.PodResources, allocations map[string]plugin.Allocation) []string {
+	missing := make([]string, 0)
+	podScope := c.podScopeContainers(pod) != nil
+	if _, ok := allocations[podAllocationKey(pod)]; podScope && ok {
+		return missing
+	}
+	for _, containerResources := range podResources.GetContainers() {
+		if len(containerResources.GetDevices()) == 0 || !isStarted(pod, containerResources.GetName()) || c.isReleased(pod, containerResources.GetName()) {
+			continue
+		}
+		if !podScope {
+			if _, ok := allocations[plugin.ContainerKey(string(pod.UID), containerResources.GetName())]; ok {
+				continue
+			}
+		}
+		for _, device := range containerResources.GetDevices() {
+			if c.resources.IsManaged(device.GetResourceName()) {
+				missing = append(missing, containerResources.GetName())
+				break
+			}
+		}
+	}
+	return missing
+}
+
+// repinIfDrifted applies the cpuset of a container again if its cgroup has drifted, and reports whether it did.
+func (c *Controller) repinIfDrifted(containerInfo cpuset.ContainerInfo, cpus cpusetutils.CPUSet) bool {
+	if containerInfo.ContainerID == "" {
+		return false
+	}
+	currentCPUs, currentMems, err := c.cpusetController.GetCPUSet(containerInfo)
+	if err != nil {
+		// The cgroup is gone while the container is restarting, the new container is pinned when it starts.
+		c.logger.V(1).Info("Failed to read the cpuset of container", "name", containerInfo.Name, "error", err.Error())
+		return false
+	}
+	mems := c.memsForCPUs(cpus)
+	if sameCPUList(currentCPUs, cpus.String()) && sameCPUList(currentMems, mems) {
+		return false
+	}
+	if err := c.cpusetController.UpdateCPUSet(containerInfo, cpus.String(), mems); err != nil {
+		c.logger.Error(err, "Failed to re-apply cpuset for container", "name", containerInfo.Name)
+		return false
+	}
+	return true
+}
+
+// sameCPUList reports whether two cpuset lists, e.g. "0-1" and "0,1", hold the same IDs.
+func sameCPUList(a string, b string) bool {
+	aSet, err := cpusetutils.Parse(a)
+	if err != nil {
+		return false
+	}
+	bSet, err := cpusetutils.Parse(b)
+	return err == nil && aSet.Equals(bSet)
+}
@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
+	corev1 "k8s.io/api/core/v1"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// seedState rebuilds the state from the devices assigned by the kubelet to the running pods, e.g. after the daemon restarts.
+// The containers that are running are pinned and their allocations recorded, and the devices of the containers that
+// have not started yet are reserved, until they are pinned by the controller.
+func (c *Controller) seedState() error {
+	c.checkAllocatableDevices()
+
+	list, err := c.podResourcesClient.List(context.TODO(), &podresources.ListPodResourcesRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list pod resources: %v", err)
+	}
+	for _, podResources := range list.GetPodResources() {
+		var pod *corev1.Pod
+		obj, exists, err := c.informer.GetStore().GetByKey(podResources.GetNamespace() + "/" + podResources.GetName())
+		if err == nil && exists {
+			pod = obj.(*corev1.Pod)
+		}
+		if pod != nil && c.validatePod(pod) {
+			if err := c.applyPodResources(pod, podResources); err != nil {
+				// The pod is retried by the workers once they start.
+				c.logger.Error(err, "Failed to apply pod resources", "name", pod.Name)
+				c.enqueuePod(pod)
+			}
+		}
+		c.reserveUnallocatedDevices(pod, podResources)
+	}
+	c.logger.Info("Rebuilt state from the kubelet pod resources", "allocations", len(c.state.GetAllocations()), "reservations", len(c.state.GetReservations()))
+	return nil
+}
+
+// reserveUnallocatedDevices reserves the devices assigned by the kubelet to the containers of a pod that hold no allocation,
+// e.g. containers that have not started yet or whose pod is not known yet, so that their CPUs are not allocated again
+// until they are pinned. The pod is nil when it is not in the informer cache.
+func (c *Controller) reserveUnallocatedDevices(pod *corev1.Pod, podResources *podresources.PodResources) {
+	allocations := c.state.GetAllocations()
+	for _, containerResources := range podResources.GetContainers() {
+		name := containerResources.GetName()
+		if pod != nil {
+			if c.isReleased(pod, name) {
+				continue
+			}
+			if _, ok := allocations[plugin.ContainerKey(string(pod.UID), name)]; ok {
+				continue
+			}
+			if podAllocation, ok := allocations[podAllocationKey(pod)]; ok {
+				if _, ok := podAllocation.ContainerDevices[name]; ok {
+					continue
+				}
+			}
+		}
+		for resourceName, deviceIDs := range containerDevices(containerResources) {
+			c.reserveDevices(resourceName, deviceIDs)
+		}
+	}
+}
+
+// reserveDevices reserves the CPUs of devices assigned to a container that has not been pinned yet.
+func (c *Controller) reserveDevices(resourceName string, deviceIDs []string) {
+	resource, ok := c.resources.Lookup(resourceName)
+	if !ok {
+		return
+	}
+	allocation, err := c.resources.AllocationForDevices(c.state.GetTopology(), map[string][]string{resourceName: deviceIDs})
+	if err != nil {
+		c.logger.Error(err, "Failed to get CPUs of devices", "resource", resourceName, "devices", deviceIDs)
+		return
+	}
+	if err := c.state.Reserve(plugin.ReservationKey(resourceName, deviceIDs), allocation); err != nil {
+		c.logger.Error(err, "Failed to reserve devices", "resource", resource.Name, "devices", deviceIDs)
+	}
+}
+
+// checkAllocatableDevices logs the devices of the daemon's resources that the kubelet knows of,
+// but which no longer map to CPUs, e.g. after the resources configuration changed.
+func (c *Controller) checkAllocatableDevices() {
+	allocatable, err := c.podResourcesClient.GetAllocatableResources(context.TODO(), &podresources.AllocatableResourcesRequest{})
+	if err != nil {
+		// GetAllocatableResources is behind a feature gate on older kubelets.
+		c.logger.Info("Kubelet allocatable resources are not available", "reason", err.Error())
+		return
+	}
+	for _, device := range allocatable.GetDevices() {
+		resource, ok := c.resources.Lookup(device.GetResourceName())
+		if !ok {
+			continue
+		}
+		for _, deviceID := range device.GetDeviceIds() {
+			if _, err := resource.CPUsForDevice(c.state.GetTopology(), deviceID); err != nil {
+				c.logger.Info("Kubelet device does not map to CPUs", "resource", device.GetResourceName(), "device", deviceID, "reason", err.Error())
+			}
+		}
+	}
+}
+
+// getPodResources returns the devices assigned to the pod by the kubelet.
+// Get is behind the KubeletPodResourcesGet feature gate, so the pod is looked up with List when it is unavailable.
+func (c *Controller) getPodResources(pod *corev1.Pod) (*podresources.PodResources, error) {
+	response, err := c.podResourcesClient.Get(context.TODO(), &podresources.GetPodResourcesRequest{
+		PodName:      pod.Name,
+		PodNamespace: pod.Namespace,
+	})
+	if err == nil {
+		return response.GetPodResources(), nil
+	}
+
+	list, listErr := c.podResourcesClient.List(context.TODO(), &podresources.ListPodResourcesRequest{})
+	if listErr != nil {
+		return nil, fmt.Errorf("get failed: %v, list failed: %v", err, listErr)
+	}
+	for _, podResources := range list.GetPodResources() {
+		if podResources.GetNamespace() == pod.Namespace && podResources.GetName() == pod.Name {
+			return podResources, nil
+		}
+	}
+	return nil, fmt.Errorf("pod %s/%s not found in pod resources", pod.Namespace, pod.Name)
+}
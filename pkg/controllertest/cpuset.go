@@ -0,0 +1,84 @@
+package controllertest
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/stefanaki/cpuset-plugin/pkg/cpuset"
+)
+
+// CPUSetUpdate is a cpuset applied by the fake CPUSetApplier.
+type CPUSetUpdate struct {
+	Container cpuset.ContainerInfo
+	CPUs      string
+	Mems      string
+}
+
+// CPUSetApplier is a fake cpuset applier, keeping the cpusets of the containers in memory, keyed by container ID.
+type CPUSetApplier struct {
+	// Err is returned by UpdateCPUSet when set, without applying the cpuset.
+	Err     error
+	cpusets map[string]CPUSetUpdate
+	updates []CPUSetUpdate
+	mutex   sync.Mutex
+}
+
+// NewCPUSetApplier creates a new CPUSetApplier.
+func NewCPUSetApplier() *CPUSetApplier {
+	return &CPUSetApplier{cpusets: make(map[string]CPUSetUpdate)}
+}
+
+func (a *CPUSetApplier) UpdateCPUSet(container cpuset.ContainerInfo, cpus, mems string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.Err != nil {
+		return a.Err
+	}
+	update := CPUSetUpdate{Container: container, CPUs: cpus, Mems: mems}
+	a.cpusets[container.ContainerID] = update
+	a.updates = append(a.updates, update)
+	return nil
+}
+
+func (a *CPUSetApplier) GetCPUSet(container cpuset.ContainerInfo) (string, string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	update, ok := a.cpusets[container.ContainerID]
+	if !ok {
+		return "", "", fmt.Errorf("cgroup of container %s: %w", container.ContainerID, os.ErrNotExist)
+	}
+	return update.CPUs, update.Mems, nil
+}
+
+// SetErr sets the error returned by UpdateCPUSet, nil to apply the cpusets again.
+func (a *CPUSetApplier) SetErr(err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.Err = err
+}
+
+// SetCPUSet overwrites the cpuset of a container, e.g. to simulate a drift of its cgroup.
+func (a *CPUSetApplier) SetCPUSet(containerID string, cpus, mems string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	update := a.cpusets[containerID]
+	update.CPUs = cpus
+	update.Mems = mems
+	a.cpusets[containerID] = update
+}
+
+// CPUSet returns the cpuset of a container, and whether one was applied.
+func (a *CPUSetApplier) CPUSet(containerID string) (CPUSetUpdate, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	update, ok := a.cpusets[containerID]
+	return update, ok
+}
+
+// Updates returns every cpuset applied so far, in order.
+func (a *CPUSetApplier) Updates() []CPUSetUpdate {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]CPUSetUpdate{}, a.updates...)
+}
@@ -0,0 +1,79 @@
+package controllertest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// PodResourcesClient is an in-memory fake of the kubelet PodResources client, serving the pod resources set by the caller.
+type PodResourcesClient struct {
+	// GetDisabled makes Get fail like on kubelets without the KubeletPodResourcesGet feature gate.
+	GetDisabled bool
+	pods        map[string]*podresources.PodResources
+	allocatable *podresources.AllocatableResourcesResponse
+	mutex       sync.Mutex
+}
+
+// NewPodResourcesClient creates a new PodResourcesClient.
+func NewPodResourcesClient() *PodResourcesClient {
+	return &PodResourcesClient{
+		pods:        make(map[string]*podresources.PodResources),
+		allocatable: &podresources.AllocatableResourcesResponse{},
+	}
+}
+
+// SetPod sets the resources reported for a pod.
+func (c *PodResourcesClient) SetPod(pod *podresources.PodResources) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pods[pod.GetNamespace()+"/"+pod.GetName()] = pod
+}
+
+// RemovePod stops reporting the resources of a pod.
+func (c *PodResourcesClient) RemovePod(namespace string, name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.pods, namespace+"/"+name)
+}
+
+// SetAllocatable sets the response of GetAllocatableResources.
+func (c *PodResourcesClient) SetAllocatable(allocatable *podresources.AllocatableResourcesResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.allocatable = allocatable
+}
+
+func (c *PodResourcesClient) List(ctx context.Context, in *podresources.ListPodResourcesRequest, opts ...grpc.CallOption) (*podresources.ListPodResourcesResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	response := &podresources.ListPodResourcesResponse{}
+	for _, pod := range c.pods {
+		response.PodResources = append(response.PodResources, pod)
+	}
+	return response, nil
+}
+
+func (c *PodResourcesClient) GetAllocatableResources(ctx context.Context, in *podresources.AllocatableResourcesRequest, opts ...grpc.CallOption) (*podresources.AllocatableResourcesResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.allocatable, nil
+}
+
+func (c *PodResourcesClient) Get(ctx context.Context, in *podresources.GetPodResourcesRequest, opts ...grpc.CallOption) (*podresources.GetPodResourcesResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.GetDisabled {
+		return nil, status.Error(codes.Unimplemented, "PodResources API Get method disabled via feature gate")
+	}
+	pod, ok := c.pods[in.GetPodNamespace()+"/"+in.GetPodName()]
+	if !ok {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("pod %s/%s not found", in.GetPodNamespace(), in.GetPodName()))
+	}
+	return &podresources.GetPodResourcesResponse{PodResources: pod}, nil
+}
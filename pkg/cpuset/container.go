@@ -64,9 +64,11 @@ func QoSFromLimit(limitCpu, requestCpu int64, limitMemory, requestMemory string)
 	return BestEffort
 }
 
+// GetContainerInfo returns the info of a regular, init or ephemeral container of the pod.
 func GetContainerInfo(container v1.Container, pod v1.Pod) ContainerInfo {
 	name := container.Name
-	for _, c := range pod.Status.ContainerStatuses {
+	statuses := append(append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...), pod.Status.EphemeralContainerStatuses...)
+	for _, c := range statuses {
 		if c.Name != name {
 			continue
 		}
@@ -8,6 +8,7 @@ import (
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"os"
 	"path"
+	"strings"
 )
 
 type CPUSetController struct {
@@ -75,3 +76,20 @@ func (c *CPUSetController) updateCPUSetV2(slice, cpus, mems string) error {
 	// Memory migration in cgroups v2 is always enabled, no need to set it.
 	return err
 }
+
+// GetCPUSet returns the cpuset.cpus and cpuset.mems currently set in the cgroup of the container.
+func (c *CPUSetController) GetCPUSet(container ContainerInfo) (cpus string, mems string, err error) {
+	dir := path.Join(c.cgroupsPath, SliceName(container, c.containerRuntime, c.cgroupsDriver))
+	if cgroups.Mode() != cgroups.Unified {
+		dir = path.Join(c.cgroupsPath, "cpuset", SliceName(container, c.containerRuntime, c.cgroupsDriver))
+	}
+	cpusData, err := os.ReadFile(path.Join(dir, "cpuset.cpus"))
+	if err != nil {
+		return "", "", err
+	}
+	memsData, err := os.ReadFile(path.Join(dir, "cpuset.mems"))
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(string(cpusData)), strings.TrimSpace(string(memsData)), nil
+}
@@ -0,0 +1,132 @@
+package cpuview
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"k8s.io/utils/cpuset"
+)
+
+// Paths of the CPU view files inside the container.
+const (
+	OnlinePath   = "/sys/devices/system/cpu/online"
+	PossiblePath = "/sys/devices/system/cpu/possible"
+	CPUInfoPath  = "/proc/cpuinfo"
+)
+
+// File represents a generated view file and the container path it is mounted over.
+type File struct {
+	HostPath      string
+	ContainerPath string
+}
+
+// Generator writes container-scoped copies of the CPU view files that list only the allocated CPUs.
+type Generator struct {
+	dir         string
+	cpuInfoPath string
+	logger      logr.Logger
+}
+
+// NewGenerator creates a new Generator that stores the view files under dir.
+// The directory must be visible at the same path on the host, since it is bind-mounted into containers.
+func NewGenerator(dir string, logger logr.Logger) (*Generator, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cpu view directory: %v", err)
+	}
+	return &Generator{
+		dir:         dir,
+		cpuInfoPath: CPUInfoPath,
+		logger:      logger.WithName("cpuview"),
+	}, nil
+}
+
+// Key returns the view key for a set of devices of a resource.
+// The device plugin and the controller derive the same key from the same devices.
+func Key(resourceName string, deviceIDs []string) string {
+	ids := append([]string{}, deviceIDs...)
+	sort.Strings(ids)
+	sum := sha256.Sum256([]byte(resourceName + "=" + strings.Join(ids, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Write generates the view files for key, listing only the given CPUs.
+// Existing files are rewritten in place so that active bind mounts observe the new contents.
+func (g *Generator) Write(key string, cpus cpuset.CPUSet) ([]File, error) {
+	viewDir := filepath.Join(g.dir, key)
+	if err := os.MkdirAll(viewDir, 0755); err != nil {
+		return nil, err
+	}
+
+	cpuInfo, err := os.ReadFile(g.cpuInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cpuinfo: %v", err)
+	}
+
+	contents := map[string][]byte{
+		OnlinePath:   []byte(cpus.String() + "\n"),
+		PossiblePath: []byte(cpus.String() + "\n"),
+		CPUInfoPath:  filterCPUInfo(cpuInfo, cpus),
+	}
+
+	files := make([]File, 0, len(contents))
+	for _, containerPath := range []string{OnlinePath, PossiblePath, CPUInfoPath} {
+		hostPath := filepath.Join(viewDir, filepath.Base(containerPath))
+		if err := os.WriteFile(hostPath, contents[containerPath], 0644); err != nil {
+			return nil, fmt.Errorf("failed to write cpu view file %s: %v", hostPath, err)
+		}
+		files = append(files, File{
+			HostPath:      hostPath,
+			ContainerPath: containerPath,
+		})
+	}
+
+	g.logger.Info("CPU view files written", "key", key, "cpus", cpus.String())
+	return files, nil
+}
+
+// Exists reports whether view files have been generated for key.
+func (g *Generator) Exists(key string) bool {
+	_, err := os.Stat(filepath.Join(g.dir, key))
+	return err == nil
+}
+
+// Remove deletes the view files for key.
+func (g *Generator) Remove(key string) error {
+	return os.RemoveAll(filepath.Join(g.dir, key))
+}
+
+// filterCPUInfo keeps only the /proc/cpuinfo processor blocks of the given CPUs.
+// Blocks without a processor field are kept as they are.
+func filterCPUInfo(data []byte, cpus cpuset.CPUSet) []byte {
+	var out strings.Builder
+	for _, block := range strings.Split(strings.TrimRight(string(data), "\n"), "\n\n") {
+		if id, ok := processorID(block); ok && !cpus.Contains(id) {
+			continue
+		}
+		out.WriteString(block)
+		out.WriteString("\n\n")
+	}
+	return []byte(out.String())
+}
+
+func processorID(block string) (int, bool) {
+	for _, line := range strings.Split(block, "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found || strings.TrimSpace(key) != "processor" {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return -1, false
+		}
+		return id, true
+	}
+	return -1, false
+}
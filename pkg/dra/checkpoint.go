@@ -0,0 +1,91 @@
+package dra
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
+	"k8s.io/utils/cpuset"
+)
+
+// checkpoint is the record of the prepared claims, kept next to the driver socket so that it survives restarts of the daemon.
+type checkpoint struct {
+	Claims map[string]checkpointClaim `json:"claims"`
+}
+
+// checkpointClaim is a prepared claim in the checkpoint, keyed by claim UID.
+type checkpointClaim struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	CPUs      string `json:"cpus"`
+}
+
+// Restore reserves the CPUs of the claims prepared before a restart of the daemon, as recorded in the checkpoint.
+// It must be called before the driver and the device plugins are started, so that the CPUs are not offered again.
+func (d *Driver) Restore() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	data, err := os.ReadFile(d.checkpointPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read DRA checkpoint: %v", err)
+	}
+	var c checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return fmt.Errorf("failed to parse DRA checkpoint: %v", err)
+	}
+	for uid, claim := range c.Claims {
+		cpus, err := cpuset.Parse(claim.CPUs)
+		if err != nil {
+			return fmt.Errorf("invalid cpus of claim %s/%s in DRA checkpoint: %v", claim.Namespace, claim.Name, err)
+		}
+		allocation := plugin.Allocation{CPUs: cpus.String(), Type: plugin.AllocationTypeClaim}
+		if err := d.state.AddAllocationIfFree(claimKeyPrefix+uid, allocation); err != nil {
+			d.logger.Error(err, "Failed to restore prepared resource claim", "namespace", claim.Namespace, "name", claim.Name)
+			continue
+		}
+		d.claims[uid] = preparedClaim{
+			namespace: claim.Namespace,
+			name:      claim.Name,
+			cpus:      cpus,
+		}
+		d.logger.Info("Restored prepared resource claim", "namespace", claim.Namespace, "name", claim.Name, "cpus", cpus.String())
+	}
+	return nil
+}
+
+// saveCheckpoint records the prepared claims. The file is replaced atomically, so that a crash leaves either version.
+func (d *Driver) saveCheckpoint() error {
+	c := checkpoint{Claims: make(map[string]checkpointClaim, len(d.claims))}
+	for uid, claim := range d.claims {
+		c.Claims[uid] = checkpointClaim{
+			Namespace: claim.namespace,
+			Name:      claim.name,
+			CPUs:      claim.cpus.String(),
+		}
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	path := d.checkpointPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkpointPath returns the path of the checkpoint of the prepared claims.
+func (d *Driver) checkpointPath() string {
+	return filepath.Join(d.pluginsPath, d.driverName, "checkpoint.json")
+}
@@ -0,0 +1,92 @@
+package dra
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// ResourceClaimResource is the API resource of the ResourceClaims, served along with the ResourceSlices.
+var ResourceClaimResource = schema.GroupVersionResource{
+	Group:    "resource.k8s.io",
+	Version:  "v1alpha2",
+	Resource: "resourceclaims",
+}
+
+// AllocationReader returns the names of the devices of the driver allocated to a resource claim.
+type AllocationReader interface {
+	AllocatedDevices(ctx context.Context, namespace string, name string, uid string) ([]string, error)
+}
+
+// ResourceClaimReader reads the devices allocated to a claim from the structured allocation result in its status,
+// i.e. the named resources of the ResourceSlice of the node picked by the scheduler.
+// The version of the kubelet DRA API served by the driver does not pass the structured result to NodePrepareResources.
+type ResourceClaimReader struct {
+	client     dynamic.Interface
+	nodeName   string
+	driverName string
+}
+
+// NewResourceClaimReader creates a new ResourceClaimReader for the claims allocated on the node.
+func NewResourceClaimReader(client dynamic.Interface, nodeName string, driverName string) *ResourceClaimReader {
+	return &ResourceClaimReader{
+		client:     client,
+		nodeName:   nodeName,
+		driverName: driverName,
+	}
+}
+
+// AllocatedDevices returns the names of the named resources of the driver allocated to the claim on the node.
+func (r *ResourceClaimReader) AllocatedDevices(ctx context.Context, namespace string, name string, uid string) ([]string, error) {
+	claim, err := r.client.Resource(ResourceClaimResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("resource claim %s/%s not found", namespace, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get resource claim %s/%s: %v", namespace, name, err)
+	}
+	if string(claim.GetUID()) != uid {
+		return nil, fmt.Errorf("resource claim %s/%s was recreated with UID %s", namespace, name, claim.GetUID())
+	}
+
+	handles, _, err := unstructured.NestedSlice(claim.Object, "status", "allocation", "resourceHandles")
+	if err != nil {
+		return nil, fmt.Errorf("invalid allocation of resource claim %s/%s: %v", namespace, name, err)
+	}
+	devices := make([]string, 0)
+	for _, obj := range handles {
+		handle, ok := obj.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if driverName, _, _ := unstructured.NestedString(handle, "driverName"); driverName != r.driverName {
+			continue
+		}
+		structured, ok, _ := unstructured.NestedMap(handle, "structuredData")
+		if !ok {
+			return nil, fmt.Errorf("resource claim %s/%s has no structured allocation result, its ResourceClass must use structured parameters", namespace, name)
+		}
+		if nodeName, _, _ := unstructured.NestedString(structured, "nodeName"); nodeName != r.nodeName {
+			return nil, fmt.Errorf("resource claim %s/%s is allocated on node %s", namespace, name, nodeName)
+		}
+		results, _, _ := unstructured.NestedSlice(structured, "results")
+		for _, result := range results {
+			resultMap, ok := result.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if device, ok, _ := unstructured.NestedString(resultMap, "namedResources", "name"); ok {
+				devices = append(devices, device)
+			}
+		}
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("resource claim %s/%s has no devices of driver %s allocated", namespace, name, r.driverName)
+	}
+	return devices, nil
+}
@@ -0,0 +1,71 @@
+package dra
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/stefanaki/cpuset-plugin/pkg/topology"
+	"k8s.io/utils/cpuset"
+)
+
+// DeviceTypeCPU is the type of the devices published by the driver. A device is named <type>-<id>, e.g. cpu-3.
+// Only CPUs are published, since the scheduler accounts for every named resource separately: devices overlapping
+// each other, such as a core and its CPUs, could be allocated to two claims at once. The core, socket and NUMA node
+// of every CPU are attributes, so that claims can still select e.g. the CPUs of a single NUMA node.
+const DeviceTypeCPU = "cpu"
+
+// Device is a device published in the ResourceSlice of the node, with its topology attributes.
+type Device struct {
+	Name     string
+	CPU      int
+	Core     int
+	Socket   int
+	NUMANode int
+}
+
+// CPUs returns the CPUs of the device.
+func (d Device) CPUs() cpuset.CPUSet {
+	return cpuset.New(d.CPU)
+}
+
+// DevicesForTopology returns every CPU of the topology as a device, except the excluded CPUs,
+// e.g. the CPUs of the pools and the shared CPUs, which are only served by their own resources.
+func DevicesForTopology(t *topology.Topology, excluded cpuset.CPUSet) []Device {
+	devices := make([]Device, 0)
+	for _, cpu := range cpuset.New(t.GetAllCPUs()...).Difference(excluded).List() {
+		device, err := deviceForName(t, fmt.Sprintf("%s-%d", DeviceTypeCPU, cpu))
+		if err != nil {
+			continue
+		}
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].CPU < devices[j].CPU
+	})
+	return devices
+}
+
+// deviceForName returns the device with the given name, e.g. cpu-3.
+func deviceForName(t *topology.Topology, name string) (Device, error) {
+	deviceType, id, found := strings.Cut(name, "-")
+	if !found || deviceType != DeviceTypeCPU {
+		return Device{}, fmt.Errorf("invalid device name: %s", name)
+	}
+	cpu, err := strconv.Atoi(id)
+	if err != nil {
+		return Device{}, fmt.Errorf("invalid device name: %s", name)
+	}
+	cpuID, coreID, socketID, numaID := t.GetCPUParentInfo(cpu)
+	if cpuID == -1 {
+		return Device{}, fmt.Errorf("device %s does not exist", name)
+	}
+	return Device{
+		Name:     name,
+		CPU:      cpu,
+		Core:     coreID,
+		Socket:   socketID,
+		NUMANode: numaID,
+	}, nil
+}
@@ -0,0 +1,269 @@
+package dra
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/stefanaki/cpuset-plugin/pkg/cdi"
+	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
+	"google.golang.org/grpc"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha3"
+	"k8s.io/utils/cpuset"
+)
+
+// DefaultDriverName is the name of the DRA driver, used as the driverName of the ResourceSlices and claims.
+const DefaultDriverName = "cpuset.stefanaki.github.com"
+
+// DefaultPluginsPath is the directory where the kubelet expects the sockets of the DRA plugins.
+const DefaultPluginsPath = "/var/lib/kubelet/plugins"
+
+// claimKeyPrefix prefixes the keys of the claim allocations in the State.
+const claimKeyPrefix = "claim://"
+
+// preparedClaim is a resource claim prepared on the node.
+type preparedClaim struct {
+	namespace string
+	name      string
+	cpus      cpuset.CPUSet
+}
+
+// Driver is the DRA kubelet plugin of the CPU devices.
+// It prepares the resource claims allocated on the node by reserving their CPUs in the State,
+// and hands the prepared cpuset to the containers through CDI.
+type Driver struct {
+	drapb.UnimplementedNodeServer
+	driverName          string
+	pluginsPath         string
+	pluginsRegistryPath string
+	state               *plugin.State
+	cdi                 *cdi.Writer
+	allocations         AllocationReader
+	grpcServer          *grpc.Server
+	registrationServer  *grpc.Server
+	claims              map[string]preparedClaim
+	mutex               sync.Mutex
+	logger              logr.Logger
+}
+
+// NewDriver creates a new DRA Driver, preparing the devices of the claims returned by allocations.
+func NewDriver(driverName string, pluginsPath string, pluginsRegistryPath string, state *plugin.State, cdiWriter *cdi.Writer, allocations AllocationReader, logger logr.Logger) *Driver {
+	return &Driver{
+		driverName:          driverName,
+		pluginsPath:         pluginsPath,
+		pluginsRegistryPath: pluginsRegistryPath,
+		state:               state,
+		cdi:                 cdiWriter,
+		allocations:         allocations,
+		claims:              make(map[string]preparedClaim),
+		logger:              logger.WithName("dra"),
+	}
+}
+
+// Start serves the DRA node service and registers the driver with the kubelet plugin watcher.
+func (d *Driver) Start() error {
+	endpoint := d.endpoint()
+	if err := os.MkdirAll(filepath.Dir(endpoint), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(endpoint); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing DRA socket: %v", err)
+	}
+	lis, err := net.Listen("unix", endpoint)
+	if err != nil {
+		d.logger.Error(err, "Starting DRA node server failed")
+		return err
+	}
+	d.grpcServer = grpc.NewServer()
+	drapb.RegisterNodeServer(d.grpcServer, d)
+	go func() {
+		if err := d.grpcServer.Serve(lis); err != nil {
+			d.logger.Error(err, "DRA node server failed")
+		}
+	}()
+	d.logger.Info("DRA node server started", "endpoint", endpoint)
+
+	return d.startRegistrationServer()
+}
+
+// Stop stops the DRA node service and the Registration service, and removes their sockets.
+func (d *Driver) Stop() {
+	if d.registrationServer != nil {
+		d.registrationServer.Stop()
+		d.registrationServer = nil
+	}
+	if d.grpcServer != nil {
+		d.grpcServer.Stop()
+		d.grpcServer = nil
+	}
+	os.Remove(d.registrationEndpoint())
+	os.Remove(d.endpoint())
+}
+
+// NodePrepareResources prepares the resource claims, reserving the CPUs of their devices.
+func (d *Driver) NodePrepareResources(ctx context.Context, request *drapb.NodePrepareResourcesRequest) (*drapb.NodePrepareResourcesResponse, error) {
+	response := &drapb.NodePrepareResourcesResponse{Claims: make(map[string]*drapb.NodePrepareResourceResponse)}
+	for _, claim := range request.GetClaims() {
+		cdiDevices, err := d.prepareClaim(ctx, claim)
+		if err != nil {
+			d.logger.Error(err, "Failed to prepare resource claim", "namespace", claim.GetNamespace(), "name", claim.GetName())
+			response.Claims[claim.GetUid()] = &drapb.NodePrepareResourceResponse{Error: err.Error()}
+			continue
+		}
+		response.Claims[claim.GetUid()] = &drapb.NodePrepareResourceResponse{CDIDevices: cdiDevices}
+	}
+	return response, nil
+}
+
+// NodeUnprepareResources releases the CPUs of the resource claims.
+func (d *Driver) NodeUnprepareResources(ctx context.Context, request *drapb.NodeUnprepareResourcesRequest) (*drapb.NodeUnprepareResourcesResponse, error) {
+	response := &drapb.NodeUnprepareResourcesResponse{Claims: make(map[string]*drapb.NodeUnprepareResourceResponse)}
+	for _, claim := range request.GetClaims() {
+		if err := d.unprepareClaim(claim); err != nil {
+			d.logger.Error(err, "Failed to unprepare resource claim", "namespace", claim.GetNamespace(), "name", claim.GetName())
+			response.Claims[claim.GetUid()] = &drapb.NodeUnprepareResourceResponse{Error: err.Error()}
+			continue
+		}
+		response.Claims[claim.GetUid()] = &drapb.NodeUnprepareResourceResponse{}
+	}
+	return response, nil
+}
+
+// PreparedCPUs returns the CPUs of a prepared resource claim.
+func (d *Driver) PreparedCPUs(namespace string, name string) (cpuset.CPUSet, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, claim := range d.claims {
+		if claim.namespace == namespace && claim.name == name {
+			return claim.cpus, true
+		}
+	}
+	return cpuset.New(), false
+}
+
+// isPrepared reports whether the claim with the given UID is prepared.
+func (d *Driver) isPrepared(uid string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, ok := d.claims[uid]
+	return ok
+}
+
+// prepareClaim reserves the CPUs of the devices allocated to the claim by the scheduler.
+func (d *Driver) prepareClaim(ctx context.Context, claim *drapb.Claim) ([]string, error) {
+	// Claims are prepared again after kubelet restarts, and their allocation cannot change while they are prepared.
+	if d.isPrepared(claim.GetUid()) {
+		return []string{cdi.QualifiedName(d.cdiKind(), claim.GetUid())}, nil
+	}
+	devices, err := d.allocations.AllocatedDevices(ctx, claim.GetNamespace(), claim.GetName(), claim.GetUid())
+	if err != nil {
+		return nil, err
+	}
+	cpus := cpuset.New()
+	for _, name := range devices {
+		device, err := deviceForName(d.state.Topology, name)
+		if err != nil {
+			return nil, err
+		}
+		cpus = cpus.Union(device.CPUs())
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// The claim may have been prepared by a concurrent call meanwhile.
+	if prepared, ok := d.claims[claim.GetUid()]; ok && !prepared.cpus.Equals(cpus) {
+		return nil, fmt.Errorf("claim already prepared with cpus %s", prepared.cpus.String())
+	}
+	for uid, prepared := range d.claims {
+		if uid == claim.GetUid() {
+			continue
+		}
+		if overlap := prepared.cpus.Intersection(cpus); !overlap.IsEmpty() {
+			return nil, fmt.Errorf("cpus %s are prepared for claim %s/%s", overlap.String(), prepared.namespace, prepared.name)
+		}
+	}
+	if reserved := d.state.GetReservedCPUs().Intersection(cpus); !reserved.IsEmpty() {
+		return nil, fmt.Errorf("cpus %s are reserved for cpu pools", reserved.String())
+	}
+
+	allocation := plugin.Allocation{CPUs: cpus.String(), Type: plugin.AllocationTypeClaim}
+	if err := d.state.AddAllocationIfFree(claimKeyPrefix+claim.GetUid(), allocation); err != nil {
+		return nil, err
+	}
+	if err := d.writeCDISpec(claim.GetUid(), cpus); err != nil {
+		d.state.RemoveAllocation(claimKeyPrefix + claim.GetUid())
+		return nil, fmt.Errorf("failed to write CDI spec: %v", err)
+	}
+	previous, wasPrepared := d.claims[claim.GetUid()]
+	d.claims[claim.GetUid()] = preparedClaim{
+		namespace: claim.GetNamespace(),
+		name:      claim.GetName(),
+		cpus:      cpus,
+	}
+	if err := d.saveCheckpoint(); err != nil {
+		if wasPrepared {
+			d.claims[claim.GetUid()] = previous
+		} else {
+			delete(d.claims, claim.GetUid())
+			d.cdi.Remove(d.cdiSpecName(claim.GetUid()))
+			d.state.RemoveAllocation(claimKeyPrefix + claim.GetUid())
+		}
+		return nil, fmt.Errorf("failed to save DRA checkpoint: %v", err)
+	}
+	d.logger.Info("Prepared resource claim", "namespace", claim.GetNamespace(), "name", claim.GetName(), "cpus", cpus.String())
+	return []string{cdi.QualifiedName(d.cdiKind(), claim.GetUid())}, nil
+}
+
+func (d *Driver) unprepareClaim(claim *drapb.Claim) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err := d.cdi.Remove(d.cdiSpecName(claim.GetUid())); err != nil {
+		return fmt.Errorf("failed to remove CDI spec: %v", err)
+	}
+	prepared, wasPrepared := d.claims[claim.GetUid()]
+	delete(d.claims, claim.GetUid())
+	if err := d.saveCheckpoint(); err != nil {
+		if wasPrepared {
+			d.claims[claim.GetUid()] = prepared
+		}
+		return fmt.Errorf("failed to save DRA checkpoint: %v", err)
+	}
+	d.state.RemoveAllocation(claimKeyPrefix + claim.GetUid())
+	d.logger.Info("Unprepared resource claim", "namespace", claim.GetNamespace(), "name", claim.GetName())
+	return nil
+}
+
+// writeCDISpec writes the CDI spec of a claim, whose single device sets the prepared cpuset in the container.
+func (d *Driver) writeCDISpec(uid string, cpus cpuset.CPUSet) error {
+	spec := &cdi.Spec{
+		Kind: d.cdiKind(),
+		Devices: []cdi.Device{{
+			Name:        uid,
+			Annotations: map[string]string{d.driverName + "/cpus": cpus.String()},
+			ContainerEdits: cdi.ContainerEdits{
+				Env: []string{fmt.Sprintf("CPUSET=%s", cpus.String())},
+			},
+		}},
+	}
+	return d.cdi.WriteAs(d.cdiSpecName(uid), spec)
+}
+
+// cdiKind returns the CDI kind of the claim devices, e.g. cpuset.stefanaki.github.com/claim.
+func (d *Driver) cdiKind() string {
+	return d.driverName + "/claim"
+}
+
+func (d *Driver) cdiSpecName(uid string) string {
+	return fmt.Sprintf("%s-%s", d.cdiKind(), uid)
+}
+
+// endpoint returns the path of the DRA node service socket.
+func (d *Driver) endpoint() string {
+	return filepath.Join(d.pluginsPath, d.driverName, "dra.sock")
+}
@@ -0,0 +1,292 @@
+package dra
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stefanaki/cpuset-plugin/pkg/cdi"
+	"github.com/stefanaki/cpuset-plugin/pkg/kubelettest"
+	"github.com/stefanaki/cpuset-plugin/pkg/plugin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha3"
+	"k8s.io/utils/cpuset"
+)
+
+const (
+	testDriverName = "cpuset.example.com"
+	testNodeName   = "node-1"
+)
+
+// testNode holds the directories of the kubelet and the runtime shared by the restarts of the driver,
+// and the API server holding the ResourceSlice and the ResourceClaims.
+type testNode struct {
+	pluginsPath  string
+	registryPath string
+	cdiWriter    *cdi.Writer
+	watcher      *kubelettest.RegistryWatcher
+	client       *dynamicfake.FakeDynamicClient
+}
+
+func newTestNode(t *testing.T) *testNode {
+	t.Helper()
+	cdiWriter, err := cdi.NewWriter(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create CDI writer: %v", err)
+	}
+	node := &testNode{
+		pluginsPath:  t.TempDir(),
+		registryPath: t.TempDir(),
+		cdiWriter:    cdiWriter,
+		client: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+			ResourceSliceResource: "ResourceSliceList",
+			ResourceClaimResource: "ResourceClaimList",
+		}),
+	}
+	node.watcher = kubelettest.NewRegistryWatcher(node.registryPath)
+	stopCh := make(chan struct{})
+	t.Cleanup(func() {
+		close(stopCh)
+	})
+	go node.watcher.Run(stopCh)
+	return node
+}
+
+// startDriver starts a driver with a fresh state, as after a restart of the daemon, and connects to it
+// through the fake kubelet once it is registered.
+func (n *testNode) startDriver(t *testing.T) (*Driver, *plugin.State, *kubelettest.DRAClient) {
+	t.Helper()
+	state, err := plugin.NewState(logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create state: %v", err)
+	}
+	driver := NewDriver(testDriverName, n.pluginsPath, n.registryPath, state, n.cdiWriter,
+		NewResourceClaimReader(n.client, testNodeName, testDriverName), logr.Discard())
+	if err := driver.Restore(); err != nil {
+		t.Fatalf("failed to restore claims: %v", err)
+	}
+	if err := driver.Start(); err != nil {
+		t.Fatalf("failed to start driver: %v", err)
+	}
+	t.Cleanup(driver.Stop)
+
+	info, err := n.watcher.WaitForPlugin(testDriverName, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := kubelettest.NewDRAClient(info)
+	if err != nil {
+		t.Fatalf("failed to connect to driver: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return driver, state, client
+}
+
+// publish publishes the devices of the node in its ResourceSlice, like the daemon does at startup.
+func (n *testNode) publish(t *testing.T, state *plugin.State) {
+	t.Helper()
+	clientset := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNodeName, UID: "node-uid"}})
+	publisher := NewResourceSlicePublisher(n.client, clientset, testNodeName, testDriverName)
+	if err := publisher.Publish(context.TODO(), DevicesForTopology(state.Topology, state.GetReservedCPUs())); err != nil {
+		t.Fatalf("failed to publish ResourceSlice: %v", err)
+	}
+}
+
+// publishedDevices returns the names of the named resources of the ResourceSlice of the node.
+func (n *testNode) publishedDevices(t *testing.T) []string {
+	t.Helper()
+	slice, err := n.client.Resource(ResourceSliceResource).Get(context.TODO(), testNodeName+"-"+testDriverName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get ResourceSlice: %v", err)
+	}
+	instances, _, err := unstructured.NestedSlice(slice.Object, "namedResources", "instances")
+	if err != nil {
+		t.Fatalf("invalid ResourceSlice: %v", err)
+	}
+	devices := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		devices = append(devices, instance.(map[string]interface{})["name"].(string))
+	}
+	return devices
+}
+
+// allocateClaim creates a ResourceClaim allocated on the node, whose structured allocation result holds the
+// named resources picked by the scheduler, and returns the claim passed by the kubelet to the driver.
+func (n *testNode) allocateClaim(t *testing.T, name string, uid string, devices ...string) *drapb.Claim {
+	t.Helper()
+	results := make([]interface{}, 0, len(devices))
+	for _, device := range devices {
+		results = append(results, map[string]interface{}{
+			"namedResources": map[string]interface{}{"name": device},
+		})
+	}
+	claim := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": ResourceClaimResource.GroupVersion().String(),
+		"kind":       "ResourceClaim",
+		"metadata": map[string]interface{}{
+			"namespace": "default",
+			"name":      name,
+			"uid":       uid,
+		},
+		"spec": map[string]interface{}{
+			"resourceClassName": "cpuset",
+		},
+		"status": map[string]interface{}{
+			"driverName": testDriverName,
+			"allocation": map[string]interface{}{
+				"resourceHandles": []interface{}{map[string]interface{}{
+					"driverName": testDriverName,
+					"structuredData": map[string]interface{}{
+						"nodeName": testNodeName,
+						"results":  results,
+					},
+				}},
+			},
+		},
+	}}
+	if _, err := n.client.Resource(ResourceClaimResource).Namespace("default").Create(context.TODO(), claim, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create ResourceClaim: %v", err)
+	}
+	// The kubelet passes no resource handle for claims allocated with structured parameters.
+	return &drapb.Claim{Namespace: "default", Name: name, Uid: uid}
+}
+
+func TestPublishedDevices(t *testing.T) {
+	state, err := plugin.NewState(logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create state: %v", err)
+	}
+	allCPUs := cpuset.New(state.Topology.GetAllCPUs()...)
+	reserved := cpuset.New(allCPUs.List()[allCPUs.Size()-1])
+	devices := DevicesForTopology(state.Topology, reserved)
+
+	// Every CPU but the reserved ones is published once, as a device of its own.
+	published := cpuset.New()
+	for _, device := range devices {
+		if device.CPUs().Intersection(published).Size() != 0 {
+			t.Errorf("device %s overlaps another device", device.Name)
+		}
+		published = published.Union(device.CPUs())
+	}
+	if want := allCPUs.Difference(reserved); !published.Equals(want) {
+		t.Errorf("published cpus = %s, want %s", published.String(), want.String())
+	}
+}
+
+func TestPrepareAllocatedClaim(t *testing.T) {
+	node := newTestNode(t)
+	driver, state, client := node.startDriver(t)
+	node.publish(t, state)
+
+	// The scheduler picks a named resource of the published ResourceSlice.
+	published := node.publishedDevices(t)
+	if len(published) == 0 {
+		t.Fatal("no device was published")
+	}
+	device, err := deviceForName(state.Topology, published[0])
+	if err != nil {
+		t.Fatalf("published device %s is not prepared by the driver: %v", published[0], err)
+	}
+	claim := node.allocateClaim(t, "benchmark", "uid-1", published[0])
+
+	devices, err := client.Prepare(claim)
+	if err != nil {
+		t.Fatalf("failed to prepare claim: %v", err)
+	}
+	if want := cdi.QualifiedName(testDriverName+"/claim", "uid-1"); len(devices) != 1 || devices[0] != want {
+		t.Errorf("CDI devices = %v, want [%s]", devices, want)
+	}
+	if cpus, ok := driver.PreparedCPUs("default", "benchmark"); !ok || !cpus.Equals(device.CPUs()) {
+		t.Errorf("prepared cpus = %s, %v, want %s", cpus.String(), ok, device.CPUs().String())
+	}
+	if _, ok := state.GetAllocation(claimKeyPrefix + "uid-1"); !ok {
+		t.Errorf("claim allocation is missing from the state")
+	}
+}
+
+func TestPrepareClaims(t *testing.T) {
+	node := newTestNode(t)
+	driver, state, client := node.startDriver(t)
+
+	claim := node.allocateClaim(t, "benchmark", "uid-1", "cpu-0")
+	if _, err := client.Prepare(claim); err != nil {
+		t.Fatalf("failed to prepare claim: %v", err)
+	}
+	if cpus, ok := driver.PreparedCPUs("default", "benchmark"); !ok || cpus.String() != "0" {
+		t.Errorf("prepared cpus = %s, %v, want 0", cpus.String(), ok)
+	}
+
+	// The kubelet prepares claims again after it restarts.
+	if _, err := client.Prepare(claim); err != nil {
+		t.Errorf("failed to prepare claim again: %v", err)
+	}
+
+	conflicting := node.allocateClaim(t, "other", "uid-2", "cpu-0")
+	if _, err := client.Prepare(conflicting); err == nil {
+		t.Errorf("prepared a claim overlapping a prepared claim")
+	}
+	if _, err := client.Prepare(node.allocateClaim(t, "invalid", "uid-3", "core-0")); err == nil {
+		t.Errorf("prepared a claim of an unknown device")
+	}
+	if _, err := client.Prepare(&drapb.Claim{Namespace: "default", Name: "missing", Uid: "uid-4"}); err == nil {
+		t.Errorf("prepared a claim that does not exist")
+	}
+	if _, err := client.Prepare(&drapb.Claim{Namespace: "default", Name: "benchmark", Uid: "uid-5"}); err == nil {
+		t.Errorf("prepared a claim whose UID does not match")
+	}
+
+	if err := client.Unprepare(claim); err != nil {
+		t.Fatalf("failed to unprepare claim: %v", err)
+	}
+	if _, ok := driver.PreparedCPUs("default", "benchmark"); ok {
+		t.Errorf("unprepared claim is still prepared")
+	}
+	if _, ok := state.GetAllocation(claimKeyPrefix + "uid-1"); ok {
+		t.Errorf("unprepared claim allocation is still in the state")
+	}
+	if _, err := client.Prepare(conflicting); err != nil {
+		t.Errorf("failed to prepare claim on released cpus: %v", err)
+	}
+}
+
+func TestRestorePreparedClaims(t *testing.T) {
+	node := newTestNode(t)
+	driver, _, client := node.startDriver(t)
+
+	claim := node.allocateClaim(t, "benchmark", "uid-1", "cpu-0")
+	if _, err := client.Prepare(claim); err != nil {
+		t.Fatalf("failed to prepare claim: %v", err)
+	}
+	driver.Stop()
+
+	driver, state, client := node.startDriver(t)
+	if cpus, ok := driver.PreparedCPUs("default", "benchmark"); !ok || cpus.String() != "0" {
+		t.Fatalf("restored cpus = %s, %v, want 0", cpus.String(), ok)
+	}
+	if _, ok := state.GetAllocation(claimKeyPrefix + "uid-1"); !ok {
+		t.Errorf("restored claim allocation is missing from the state")
+	}
+	conflicting := node.allocateClaim(t, "other", "uid-2", "cpu-0")
+	if _, err := client.Prepare(conflicting); err == nil {
+		t.Errorf("prepared a claim overlapping a restored claim")
+	}
+
+	if err := client.Unprepare(claim); err != nil {
+		t.Fatalf("failed to unprepare claim: %v", err)
+	}
+	driver.Stop()
+
+	driver, _, _ = node.startDriver(t)
+	if _, ok := driver.PreparedCPUs("default", "benchmark"); ok {
+		t.Errorf("unprepared claim was restored")
+	}
+}
@@ -0,0 +1,109 @@
+package dra
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ResourceSliceResource is the API resource of the ResourceSlices describing the devices of a node.
+// ResourceSlices are only served as resource.k8s.io/v1alpha2 by Kubernetes 1.30, with the DynamicResourceAllocation
+// feature gate and the resource.k8s.io/v1alpha2 API enabled. They are not part of the vendored k8s.io/api, hence the dynamic client.
+var ResourceSliceResource = schema.GroupVersionResource{
+	Group:    "resource.k8s.io",
+	Version:  "v1alpha2",
+	Resource: "resourceslices",
+}
+
+// Publisher publishes the devices of the node.
+type Publisher interface {
+	Publish(ctx context.Context, devices []Device) error
+}
+
+// ResourceSlicePublisher publishes the devices of the node as the named resources of a ResourceSlice.
+// The ResourceSlice is owned by the Node, so that it is deleted along with it.
+type ResourceSlicePublisher struct {
+	client     dynamic.Interface
+	clientset  kubernetes.Interface
+	nodeName   string
+	driverName string
+}
+
+// NewResourceSlicePublisher creates a new ResourceSlicePublisher for the node.
+func NewResourceSlicePublisher(client dynamic.Interface, clientset kubernetes.Interface, nodeName string, driverName string) *ResourceSlicePublisher {
+	return &ResourceSlicePublisher{
+		client:     client,
+		clientset:  clientset,
+		nodeName:   nodeName,
+		driverName: driverName,
+	}
+}
+
+// Publish creates or updates the ResourceSlice of the node.
+func (p *ResourceSlicePublisher) Publish(ctx context.Context, devices []Device) error {
+	node, err := p.clientset.CoreV1().Nodes().Get(ctx, p.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get node: %v", err)
+	}
+
+	slice := p.resourceSlice(devices)
+	slice.SetOwnerReferences([]metav1.OwnerReference{{
+		APIVersion: "v1",
+		Kind:       "Node",
+		Name:       node.Name,
+		UID:        node.UID,
+	}})
+
+	slices := p.client.Resource(ResourceSliceResource)
+	existing, err := slices.Get(ctx, slice.GetName(), metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		_, err = slices.Create(ctx, slice, metav1.CreateOptions{})
+	case err == nil:
+		slice.SetResourceVersion(existing.GetResourceVersion())
+		_, err = slices.Update(ctx, slice, metav1.UpdateOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to publish ResourceSlice, %s is not served by the cluster (Kubernetes 1.30 with DynamicResourceAllocation is required): %v",
+			ResourceSliceResource.String(), err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to publish ResourceSlice: %v", err)
+	}
+	return nil
+}
+
+// resourceSlice returns the ResourceSlice describing the devices.
+func (p *ResourceSlicePublisher) resourceSlice(devices []Device) *unstructured.Unstructured {
+	instances := make([]interface{}, 0, len(devices))
+	for _, device := range devices {
+		instances = append(instances, map[string]interface{}{
+			"name": device.Name,
+			"attributes": []interface{}{
+				map[string]interface{}{"name": "cpu", "int": int64(device.CPU)},
+				map[string]interface{}{"name": "core", "int": int64(device.Core)},
+				map[string]interface{}{"name": "socket", "int": int64(device.Socket)},
+				map[string]interface{}{"name": "numaNode", "int": int64(device.NUMANode)},
+			},
+		})
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": ResourceSliceResource.GroupVersion().String(),
+		"kind":       "ResourceSlice",
+		"metadata": map[string]interface{}{
+			"name": fmt.Sprintf("%s-%s", p.nodeName, p.driverName),
+		},
+		"nodeName":   p.nodeName,
+		"driverName": p.driverName,
+		"namedResources": map[string]interface{}{
+			"instances": instances,
+		},
+	}}
+}
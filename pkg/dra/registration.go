@@ -0,0 +1,70 @@
+package dra
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// supportedVersions are the versions of the DRA node service served by the driver.
+var supportedVersions = []string{"1.0.0"}
+
+// registrationHandler serves the pluginregistration Registration service of the driver.
+type registrationHandler struct {
+	driver *Driver
+}
+
+func (h *registrationHandler) GetInfo(ctx context.Context, request *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	return &registerapi.PluginInfo{
+		Type:              registerapi.DRAPlugin,
+		Name:              h.driver.driverName,
+		Endpoint:          h.driver.endpoint(),
+		SupportedVersions: supportedVersions,
+	}, nil
+}
+
+func (h *registrationHandler) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	if !status.PluginRegistered {
+		h.driver.logger.Error(fmt.Errorf("%s", status.Error), "Kubelet rejected DRA driver registration")
+	} else {
+		h.driver.logger.Info("DRA driver registered to Kubelet")
+	}
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
+
+// startRegistrationServer serves the Registration service in the plugins registry directory.
+// Unlike the device plugins, the driver does not wait for the registration: the kubelet calls it once registered.
+func (d *Driver) startRegistrationServer() error {
+	registrationEndpoint := d.registrationEndpoint()
+	if err := os.MkdirAll(filepath.Dir(registrationEndpoint), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(registrationEndpoint); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing registration socket: %v", err)
+	}
+	lis, err := net.Listen("unix", registrationEndpoint)
+	if err != nil {
+		d.logger.Error(err, "Starting registration server failed")
+		return err
+	}
+
+	d.registrationServer = grpc.NewServer()
+	registerapi.RegisterRegistrationServer(d.registrationServer, &registrationHandler{driver: d})
+	go func(server *grpc.Server) {
+		if err := server.Serve(lis); err != nil {
+			d.logger.Error(err, "Registration server failed")
+		}
+	}(d.registrationServer)
+	d.logger.Info("Waiting for the kubelet plugin watcher", "endpoint", registrationEndpoint)
+	return nil
+}
+
+// registrationEndpoint returns the path of the Registration service socket in the plugins registry directory.
+func (d *Driver) registrationEndpoint() string {
+	return filepath.Join(d.pluginsRegistryPath, fmt.Sprintf("%s-reg.sock", d.driverName))
+}
@@ -0,0 +1,175 @@
+package health
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stefanaki/cpuset-plugin/pkg/topology"
+	"k8s.io/utils/cpuset"
+)
+
+// Reasons for a CPU being reported unhealthy.
+const (
+	ReasonOffline    = "Offline"
+	ReasonThrottling = "ThermalThrottling"
+	ReasonAdmin      = "MarkedUnhealthy"
+)
+
+// throttleRecoveryIntervals is the number of intervals the thermal throttle counters of a CPU must stay flat
+// before it is reported healthy again, so that its health does not flap between ticks.
+const throttleRecoveryIntervals = 3
+
+// Checker periodically checks the health of every CPU in the topology.
+// A CPU is unhealthy when it is offline, when its thermal throttle counters increase,
+// or when it has been marked unhealthy by the administrator. A throttled CPU is reported healthy again once its counters
+// have stayed flat for throttleRecoveryIntervals intervals.
+type Checker struct {
+	topology       *topology.Topology
+	sysfsPath      string
+	interval       time.Duration
+	adminUnhealthy cpuset.CPUSet
+	unhealthy      map[int]string
+	throttleCounts map[string]uint64
+	flatIntervals  map[int]int
+	subscribers    map[chan struct{}]struct{}
+	mutex          sync.Mutex
+	logger         logr.Logger
+}
+
+// NewChecker creates a new Checker for the CPUs of the topology.
+func NewChecker(t *topology.Topology, sysfsPath string, interval time.Duration, adminUnhealthy cpuset.CPUSet, logger logr.Logger) *Checker {
+	return &Checker{
+		topology:       t,
+		sysfsPath:      sysfsPath,
+		interval:       interval,
+		adminUnhealthy: adminUnhealthy,
+		unhealthy:      make(map[int]string),
+		throttleCounts: make(map[string]uint64),
+		flatIntervals:  make(map[int]int),
+		subscribers:    make(map[chan struct{}]struct{}),
+		logger:         logger.WithName("health"),
+	}
+}
+
+// Run checks the CPUs every interval until stopCh is closed.
+func (c *Checker) Run(stopCh <-chan struct{}) {
+	c.check()
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.check()
+		case <-stopCh:
+			c.logger.Info("Stopping CPU health checker")
+			return
+		}
+	}
+}
+
+// IsHealthy reports whether all the given CPUs are healthy.
+func (c *Checker) IsHealthy(cpus cpuset.CPUSet) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, cpu := range cpus.List() {
+		if _, ok := c.unhealthy[cpu]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribe returns a channel that is notified whenever the health of a CPU changes,
+// and a function that cancels the subscription.
+func (c *Checker) Subscribe() (<-chan struct{}, func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ch := make(chan struct{}, 1)
+	c.subscribers[ch] = struct{}{}
+	return ch, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		delete(c.subscribers, ch)
+	}
+}
+
+func (c *Checker) check() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	changed := false
+	for _, cpu := range c.topology.GetAllCPUs() {
+		reason := c.checkCPU(cpu)
+		previous, wasUnhealthy := c.unhealthy[cpu]
+		switch {
+		case reason != "" && (!wasUnhealthy || previous != reason):
+			c.logger.Info("CPU became unhealthy", "cpu", cpu, "reason", reason)
+			c.unhealthy[cpu] = reason
+			changed = true
+		case reason == "" && wasUnhealthy:
+			c.logger.Info("CPU became healthy", "cpu", cpu, "previousReason", previous)
+			delete(c.unhealthy, cpu)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return
+	}
+	for ch := range c.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// checkCPU returns the reason the CPU is unhealthy, or an empty string if it is healthy.
+func (c *Checker) checkCPU(cpu int) string {
+	if c.adminUnhealthy.Contains(cpu) {
+		return ReasonAdmin
+	}
+
+	cpuPath := filepath.Join(c.sysfsPath, "devices/system/cpu", fmt.Sprintf("cpu%d", cpu))
+	// CPUs that cannot be hot-plugged, such as cpu0, have no online file.
+	if online, err := os.ReadFile(filepath.Join(cpuPath, "online")); err == nil && strings.TrimSpace(string(online)) == "0" {
+		return ReasonOffline
+	}
+
+	counters, _ := filepath.Glob(filepath.Join(cpuPath, "thermal_throttle", "*_count"))
+	throttling := false
+	for _, counter := range counters {
+		data, err := os.ReadFile(counter)
+		if err != nil {
+			continue
+		}
+		count, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			continue
+		}
+		if previous, ok := c.throttleCounts[counter]; ok && count > previous {
+			throttling = true
+		}
+		c.throttleCounts[counter] = count
+	}
+	if throttling {
+		c.flatIntervals[cpu] = 0
+		return ReasonThrottling
+	}
+	// A throttled CPU stays unhealthy until its counters have stayed flat for throttleRecoveryIntervals.
+	if flat, ok := c.flatIntervals[cpu]; ok {
+		if flat+1 < throttleRecoveryIntervals {
+			c.flatIntervals[cpu] = flat + 1
+			return ReasonThrottling
+		}
+		delete(c.flatIntervals, cpu)
+	}
+
+	return ""
+}
@@ -0,0 +1,68 @@
+package kubelettest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha3"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// DRAClient is a fake kubelet DRA manager.
+// It calls the node service of a DRA plugin registered through the plugin watcher, like the kubelet does
+// before starting and after stopping the containers of a pod.
+type DRAClient struct {
+	conn   *grpc.ClientConn
+	client drapb.NodeClient
+}
+
+// NewDRAClient connects to the node service of a registered DRA plugin.
+func NewDRAClient(info *registerapi.PluginInfo) (*DRAClient, error) {
+	if info.Type != registerapi.DRAPlugin {
+		return nil, fmt.Errorf("plugin %s is not a DRA plugin: %s", info.Name, info.Type)
+	}
+	conn, err := dial(info.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &DRAClient{conn: conn, client: drapb.NewNodeClient(conn)}, nil
+}
+
+// Prepare prepares a single claim and returns its CDI devices.
+func (c *DRAClient) Prepare(claim *drapb.Claim) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	response, err := c.client.NodePrepareResources(ctx, &drapb.NodePrepareResourcesRequest{Claims: []*drapb.Claim{claim}})
+	if err != nil {
+		return nil, err
+	}
+	result, ok := response.GetClaims()[claim.GetUid()]
+	if !ok {
+		return nil, fmt.Errorf("claim %s was not prepared", claim.GetUid())
+	}
+	if result.GetError() != "" {
+		return nil, fmt.Errorf("preparing claim %s failed: %s", claim.GetUid(), result.GetError())
+	}
+	return result.GetCDIDevices(), nil
+}
+
+// Unprepare unprepares a single claim.
+func (c *DRAClient) Unprepare(claim *drapb.Claim) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	response, err := c.client.NodeUnprepareResources(ctx, &drapb.NodeUnprepareResourcesRequest{Claims: []*drapb.Claim{claim}})
+	if err != nil {
+		return err
+	}
+	if result := response.GetClaims()[claim.GetUid()]; result.GetError() != "" {
+		return fmt.Errorf("unpreparing claim %s failed: %s", claim.GetUid(), result.GetError())
+	}
+	return nil
+}
+
+// Close closes the connection to the plugin.
+func (c *DRAClient) Close() error {
+	return c.conn.Close()
+}
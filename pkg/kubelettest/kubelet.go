@@ -0,0 +1,187 @@
+package kubelettest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Kubelet is a fake kubelet device manager.
+// It serves the device plugin Registration service on kubelet.sock in a device plugins directory, connects to the
+// registered plugins, follows their ListAndWatch streams and calls Allocate on them, like the kubelet does.
+// Stopping and starting it again recreates kubelet.sock, like a kubelet restart.
+type Kubelet struct {
+	dir     string
+	server  *grpc.Server
+	plugins map[string]*registeredPlugin
+	mutex   sync.Mutex
+}
+
+// registeredPlugin is a device plugin registered with the fake kubelet.
+type registeredPlugin struct {
+	request *pluginapi.RegisterRequest
+	conn    *grpc.ClientConn
+	client  pluginapi.DevicePluginClient
+	cancel  context.CancelFunc
+	devices []*pluginapi.Device
+}
+
+// NewKubelet creates a new Kubelet serving in the device plugins directory.
+func NewKubelet(dir string) *Kubelet {
+	return &Kubelet{
+		dir:     dir,
+		plugins: make(map[string]*registeredPlugin),
+	}
+}
+
+// Start serves the Registration service on kubelet.sock.
+func (k *Kubelet) Start() error {
+	if err := os.MkdirAll(k.dir, 0755); err != nil {
+		return err
+	}
+	socket := k.Socket()
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	k.server = grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(k.server, &registrationServer{kubelet: k})
+	go k.server.Serve(lis)
+	return nil
+}
+
+// Stop stops serving the Registration service, disconnects from the plugins and removes kubelet.sock.
+func (k *Kubelet) Stop() {
+	if k.server != nil {
+		k.server.Stop()
+		k.server = nil
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for name, plugin := range k.plugins {
+		plugin.cancel()
+		plugin.conn.Close()
+		delete(k.plugins, name)
+	}
+	os.Remove(k.Socket())
+}
+
+// Socket returns the path of kubelet.sock.
+func (k *Kubelet) Socket() string {
+	return filepath.Join(k.dir, filepath.Base(pluginapi.KubeletSocket))
+}
+
+// Devices returns the devices last advertised by the plugin of a resource.
+func (k *Kubelet) Devices(resourceName string) []*pluginapi.Device {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	plugin, ok := k.plugins[resourceName]
+	if !ok {
+		return nil
+	}
+	return plugin.devices
+}
+
+// WaitForDevices waits until the plugin of a resource is registered and advertises at least one device.
+func (k *Kubelet) WaitForDevices(resourceName string, timeout time.Duration) ([]*pluginapi.Device, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if devices := k.Devices(resourceName); len(devices) > 0 {
+			return devices, nil
+		}
+		time.Sleep(pollInterval)
+	}
+	return nil, fmt.Errorf("resource %s did not advertise devices within %v", resourceName, timeout)
+}
+
+// Allocate allocates devices of a resource to a single container.
+func (k *Kubelet) Allocate(resourceName string, deviceIDs ...string) (*pluginapi.ContainerAllocateResponse, error) {
+	k.mutex.Lock()
+	plugin, ok := k.plugins[resourceName]
+	k.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("resource %s is not registered", resourceName)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	response, err := plugin.client.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: deviceIDs}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(response.GetContainerResponses()) != 1 {
+		return nil, fmt.Errorf("expected 1 container response, got %d", len(response.GetContainerResponses()))
+	}
+	return response.GetContainerResponses()[0], nil
+}
+
+func (k *Kubelet) register(request *pluginapi.RegisterRequest) error {
+	if request.GetVersion() != pluginapi.Version {
+		return fmt.Errorf("unsupported device plugin API version: %s", request.GetVersion())
+	}
+	conn, err := dial(filepath.Join(k.dir, request.GetEndpoint()))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	plugin := &registeredPlugin{
+		request: request,
+		conn:    conn,
+		client:  pluginapi.NewDevicePluginClient(conn),
+		cancel:  cancel,
+	}
+
+	k.mutex.Lock()
+	if previous, ok := k.plugins[request.GetResourceName()]; ok {
+		previous.cancel()
+		previous.conn.Close()
+	}
+	k.plugins[request.GetResourceName()] = plugin
+	k.mutex.Unlock()
+
+	// The kubelet calls ListAndWatch only after Register returns.
+	go k.listAndWatch(ctx, request.GetResourceName(), plugin)
+	return nil
+}
+
+func (k *Kubelet) listAndWatch(ctx context.Context, resourceName string, plugin *registeredPlugin) {
+	stream, err := plugin.client.ListAndWatch(ctx, &pluginapi.Empty{})
+	if err != nil {
+		return
+	}
+	for {
+		response, err := stream.Recv()
+		if err != nil {
+			return
+		}
+		k.mutex.Lock()
+		if k.plugins[resourceName] == plugin {
+			plugin.devices = response.GetDevices()
+		}
+		k.mutex.Unlock()
+	}
+}
+
+// registrationServer serves the device plugin Registration service of the fake kubelet.
+type registrationServer struct {
+	kubelet *Kubelet
+}
+
+func (s *registrationServer) Register(ctx context.Context, request *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	if err := s.kubelet.register(request); err != nil {
+		return nil, err
+	}
+	return &pluginapi.Empty{}, nil
+}
@@ -0,0 +1,128 @@
+package kubelettest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// PodResourcesServer is a fake kubelet PodResources service, serving the pod resources set by the caller over gRPC,
+// so that the PodResources client of the controller can be exercised like against a kubelet.
+type PodResourcesServer struct {
+	podresources.UnimplementedPodResourcesListerServer
+	// GetDisabled makes Get fail like on kubelets without the KubeletPodResourcesGet feature gate.
+	GetDisabled bool
+	// AllocatableDisabled makes GetAllocatableResources fail like on kubelets without the KubeletPodResourcesGetAllocatable feature gate.
+	AllocatableDisabled bool
+	socket              string
+	server              *grpc.Server
+	pods                map[string]*podresources.PodResources
+	allocatable         *podresources.AllocatableResourcesResponse
+	mutex               sync.Mutex
+}
+
+// NewPodResourcesServer creates a new PodResourcesServer serving on the socket.
+func NewPodResourcesServer(socket string) *PodResourcesServer {
+	return &PodResourcesServer{
+		socket:      socket,
+		pods:        make(map[string]*podresources.PodResources),
+		allocatable: &podresources.AllocatableResourcesResponse{},
+	}
+}
+
+// Start serves the PodResources service.
+func (s *PodResourcesServer) Start() error {
+	if err := os.MkdirAll(filepath.Dir(s.socket), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(s.socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	lis, err := net.Listen("unix", s.socket)
+	if err != nil {
+		return err
+	}
+	s.server = grpc.NewServer()
+	podresources.RegisterPodResourcesListerServer(s.server, s)
+	go s.server.Serve(lis)
+	return nil
+}
+
+// Stop stops serving the PodResources service and removes its socket.
+func (s *PodResourcesServer) Stop() {
+	if s.server != nil {
+		s.server.Stop()
+		s.server = nil
+	}
+	os.Remove(s.socket)
+}
+
+// Socket returns the path of the socket of the PodResources service.
+func (s *PodResourcesServer) Socket() string {
+	return s.socket
+}
+
+// SetPod sets the resources reported for a pod.
+func (s *PodResourcesServer) SetPod(pod *podresources.PodResources) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pods[podKey(pod.GetNamespace(), pod.GetName())] = pod
+}
+
+// RemovePod stops reporting the resources of a pod.
+func (s *PodResourcesServer) RemovePod(namespace string, name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.pods, podKey(namespace, name))
+}
+
+// SetAllocatable sets the response of GetAllocatableResources.
+func (s *PodResourcesServer) SetAllocatable(allocatable *podresources.AllocatableResourcesResponse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.allocatable = allocatable
+}
+
+func (s *PodResourcesServer) List(ctx context.Context, request *podresources.ListPodResourcesRequest) (*podresources.ListPodResourcesResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	response := &podresources.ListPodResourcesResponse{}
+	for _, pod := range s.pods {
+		response.PodResources = append(response.PodResources, pod)
+	}
+	return response, nil
+}
+
+func (s *PodResourcesServer) Get(ctx context.Context, request *podresources.GetPodResourcesRequest) (*podresources.GetPodResourcesResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.GetDisabled {
+		return nil, status.Error(codes.Unimplemented, "PodResources API Get method disabled via feature gate")
+	}
+	pod, ok := s.pods[podKey(request.GetPodNamespace(), request.GetPodName())]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "pod %s/%s not found", request.GetPodNamespace(), request.GetPodName())
+	}
+	return &podresources.GetPodResourcesResponse{PodResources: pod}, nil
+}
+
+func (s *PodResourcesServer) GetAllocatableResources(ctx context.Context, request *podresources.AllocatableResourcesRequest) (*podresources.AllocatableResourcesResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.AllocatableDisabled {
+		return nil, status.Error(codes.Unimplemented, "PodResources API GetAllocatableResources disabled via feature gate")
+	}
+	return s.allocatable, nil
+}
+
+func podKey(namespace string, name string) string {
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
@@ -0,0 +1,146 @@
+package kubelettest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// pollInterval is how often the fake kubelet scans its directories.
+const pollInterval = 100 * time.Millisecond
+
+// RegistryWatcher is a fake kubelet plugin watcher.
+// It discovers the Registration service sockets in a plugins registry directory, fetches their plugin info
+// and reports the registration status back to the plugins, like the kubelet does.
+type RegistryWatcher struct {
+	dir string
+	// Validate decides whether a discovered plugin is accepted. All plugins are accepted when nil.
+	Validate func(info *registerapi.PluginInfo) error
+	plugins  map[string]*registerapi.PluginInfo
+	mutex    sync.Mutex
+}
+
+// NewRegistryWatcher creates a new RegistryWatcher for the plugins registry directory.
+func NewRegistryWatcher(dir string) *RegistryWatcher {
+	return &RegistryWatcher{
+		dir:     dir,
+		plugins: make(map[string]*registerapi.PluginInfo),
+	}
+}
+
+// Run scans the plugins registry directory until stopCh is closed.
+func (w *RegistryWatcher) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		w.scan()
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// Plugins returns the info of the registered plugins, keyed by plugin name.
+func (w *RegistryWatcher) Plugins() map[string]*registerapi.PluginInfo {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	plugins := make(map[string]*registerapi.PluginInfo, len(w.plugins))
+	for _, info := range w.plugins {
+		plugins[info.Name] = info
+	}
+	return plugins
+}
+
+// WaitForPlugin waits until a plugin with the given name is registered.
+func (w *RegistryWatcher) WaitForPlugin(name string, timeout time.Duration) (*registerapi.PluginInfo, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if info, ok := w.Plugins()[name]; ok {
+			return info, nil
+		}
+		time.Sleep(pollInterval)
+	}
+	return nil, fmt.Errorf("plugin %s was not registered within %v", name, timeout)
+}
+
+func (w *RegistryWatcher) scan() {
+	sockets, _ := filepath.Glob(filepath.Join(w.dir, "*.sock"))
+	present := make(map[string]struct{}, len(sockets))
+	for _, socket := range sockets {
+		present[socket] = struct{}{}
+		w.mutex.Lock()
+		_, known := w.plugins[socket]
+		w.mutex.Unlock()
+		if known {
+			continue
+		}
+		info, err := w.register(socket)
+		if err != nil {
+			continue
+		}
+		w.mutex.Lock()
+		w.plugins[socket] = info
+		w.mutex.Unlock()
+	}
+
+	// Forget removed sockets so that recreated ones are registered again.
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for socket := range w.plugins {
+		if _, ok := present[socket]; !ok {
+			delete(w.plugins, socket)
+		}
+	}
+}
+
+func (w *RegistryWatcher) register(socket string) (*registerapi.PluginInfo, error) {
+	conn, err := dial(socket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	client := registerapi.NewRegistrationClient(conn)
+	info, err := client.GetInfo(ctx, &registerapi.InfoRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	status := &registerapi.RegistrationStatus{PluginRegistered: true}
+	if w.Validate != nil {
+		if err := w.Validate(info); err != nil {
+			status = &registerapi.RegistrationStatus{PluginRegistered: false, Error: err.Error()}
+		}
+	}
+	if _, err := client.NotifyRegistrationStatus(ctx, status); err != nil {
+		return nil, err
+	}
+	if !status.PluginRegistered {
+		return nil, fmt.Errorf("plugin %s rejected: %s", info.Name, status.Error)
+	}
+	return info, nil
+}
+
+// dial connects to a gRPC server listening on a unix socket.
+func dial(socket string) (*grpc.ClientConn, error) {
+	if _, err := os.Stat(socket); err != nil {
+		return nil, err
+	}
+	return grpc.Dial(socket, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			d := &net.Dialer{}
+			return d.DialContext(ctx, "unix", addr)
+		}))
+}
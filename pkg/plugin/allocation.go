@@ -1,5 +1,14 @@
 package plugin
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/utils/cpuset"
+)
+
 type AllocationType string
 
 const (
@@ -7,9 +16,74 @@ const (
 	AllocationTypeNUMA   AllocationType = "AllocationTypeNUMA"
 	AllocationTypeCore   AllocationType = "AllocationTypeCore"
 	AllocationTypeCPU    AllocationType = "AllocationTypeCPU"
+	AllocationTypePool   AllocationType = "AllocationTypePool"
+	AllocationTypeShared AllocationType = "AllocationTypeShared"
+	// AllocationTypeCombined is the type of allocations made of devices of several resource types.
+	AllocationTypeCombined AllocationType = "AllocationTypeCombined"
+	// AllocationTypeClaim is the type of allocations prepared for DRA resource claims.
+	AllocationTypeClaim AllocationType = "AllocationTypeClaim"
 )
 
 type Allocation struct {
-	CPUs string         `json:"cpus"`
-	Type AllocationType `json:"type"`
+	CPUs    string              `json:"cpus"`
+	Type    AllocationType      `json:"type"`
+	Devices map[string][]string `json:"devices,omitempty"`
+	// CPUsByType holds the CPUs of a combined allocation for each allocation type it is made of.
+	CPUsByType map[AllocationType]string `json:"cpusByType,omitempty"`
+	// ContainerDevices holds the devices of each container of a pod-wide allocation, keyed by container name.
+	ContainerDevices map[string]map[string][]string `json:"containerDevices,omitempty"`
+	// ContainerID is the ID of the container the cpuset was last applied to. It changes when the container restarts.
+	ContainerID string `json:"containerID,omitempty"`
+}
+
+// cpusByType returns the CPUs of the allocation for each allocation type it is made of.
+func (a Allocation) cpusByType() map[AllocationType]cpuset.CPUSet {
+	if len(a.CPUsByType) == 0 {
+		cpus, _ := cpuset.Parse(a.CPUs)
+		return map[AllocationType]cpuset.CPUSet{a.Type: cpus}
+	}
+	parts := make(map[AllocationType]cpuset.CPUSet, len(a.CPUsByType))
+	for allocationType, cpusStr := range a.CPUsByType {
+		cpus, _ := cpuset.Parse(cpusStr)
+		parts[allocationType] = cpus
+	}
+	return parts
+}
+
+// Reservation holds CPUs reserved by Allocate until the container they were allocated to is pinned.
+type Reservation struct {
+	Allocation
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ReservationKey returns the key of the reservation of a set of devices of a resource.
+func ReservationKey(resourceName string, deviceIDs []string) string {
+	ids := append([]string{}, deviceIDs...)
+	sort.Strings(ids)
+	return fmt.Sprintf("%s=%s", resourceName, strings.Join(ids, ","))
+}
+
+// ContainerKey returns the key of the allocation of a container, which outlives the restarts of the container.
+func ContainerKey(podUID string, containerName string) string {
+	return fmt.Sprintf("%s/%s", podUID, containerName)
+}
+
+// ParseContainerKey returns the pod UID and the container name of a ContainerKey.
+// It fails for the keys of other allocations, such as pod-wide and claim allocations.
+func ParseContainerKey(key string) (podUID string, containerName string, ok bool) {
+	if strings.Contains(key, "://") {
+		return "", "", false
+	}
+	podUID, containerName, ok = strings.Cut(key, "/")
+	return podUID, containerName, ok && podUID != "" && containerName != ""
+}
+
+// ConflictError is returned when CPUs are already held through a different resource type.
+type ConflictError struct {
+	CPUs   string
+	Holder string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("CPUs %s are already held by %s", e.CPUs, e.Holder)
 }
@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stefanaki/cpuset-plugin/pkg/cdi"
+	"github.com/stefanaki/cpuset-plugin/pkg/cpuview"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// cdiViewDevicePrefix prefixes the names of the CDI devices mounting the CPU view files of an allocation.
+const cdiViewDevicePrefix = "view-"
+
+// writeCDISpec writes the CDI spec describing every device of the plugin,
+// and the CPU view files of the allocations as devices named after their view key, e.g. view-0123456789abcdef.
+func (c *CPUSetDevicePluginDriver) writeCDISpec() error {
+	c.cdiMutex.Lock()
+	defer c.cdiMutex.Unlock()
+	spec := &cdi.Spec{
+		Kind:    c.resourceName(),
+		Devices: make([]cdi.Device, 0),
+	}
+	for _, deviceID := range c.resource.DeviceIDs(c.state.Topology) {
+		cpus := c.getCPUSetForDevice(deviceID)
+		spec.Devices = append(spec.Devices, cdi.Device{
+			Name: deviceID,
+			Annotations: map[string]string{
+				fmt.Sprintf("%s/cpus", c.domain): cpus.String(),
+			},
+			ContainerEdits: cdi.ContainerEdits{
+				Env: []string{fmt.Sprintf("%s=%s", c.deviceEnvName(deviceID), cpus.String())},
+			},
+		})
+	}
+	for key, mounts := range c.cdiViews {
+		// The view files of released allocations are removed by the controller.
+		if c.cpuView == nil || !c.cpuView.Exists(key) {
+			delete(c.cdiViews, key)
+			continue
+		}
+		spec.Devices = append(spec.Devices, cdi.Device{
+			Name:           cdiViewDevicePrefix + key,
+			ContainerEdits: cdi.ContainerEdits{Mounts: mounts},
+		})
+	}
+	return c.options.CDI.Write(spec)
+}
+
+// addCDIView adds the CPU view files of an allocation to the CDI spec, and returns the CDI device mounting them.
+func (c *CPUSetDevicePluginDriver) addCDIView(key string, files []cpuview.File) (*pluginapi.CDIDevice, error) {
+	mounts := make([]cdi.Mount, 0, len(files))
+	for _, file := range files {
+		mounts = append(mounts, cdi.Mount{
+			HostPath:      file.HostPath,
+			ContainerPath: file.ContainerPath,
+			Type:          "bind",
+			Options:       []string{"ro", "bind"},
+		})
+	}
+	c.cdiMutex.Lock()
+	c.cdiViews[key] = mounts
+	c.cdiMutex.Unlock()
+	if err := c.writeCDISpec(); err != nil {
+		return nil, err
+	}
+	return &pluginapi.CDIDevice{Name: cdi.QualifiedName(c.resourceName(), cdiViewDevicePrefix+key)}, nil
+}
+
+// loadCDIViews restores the CPU view devices of the spec written before a restart of the daemon, so that containers
+// allocated before the restart can still resolve them. The devices of released allocations are pruned when the spec is written.
+func (c *CPUSetDevicePluginDriver) loadCDIViews() error {
+	spec, err := c.options.CDI.Read(c.resourceName())
+	if err != nil || spec == nil {
+		return err
+	}
+	c.cdiMutex.Lock()
+	defer c.cdiMutex.Unlock()
+	for _, device := range spec.Devices {
+		key, ok := strings.CutPrefix(device.Name, cdiViewDevicePrefix)
+		if !ok {
+			continue
+		}
+		if _, ok := c.cdiViews[key]; !ok {
+			c.cdiViews[key] = device.ContainerEdits.Mounts
+		}
+	}
+	return nil
+}
+
+// cdiDevices returns the CDI devices of the allocated device IDs.
+func (c *CPUSetDevicePluginDriver) cdiDevices(deviceIDs []string) []*pluginapi.CDIDevice {
+	devices := make([]*pluginapi.CDIDevice, 0, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		devices = append(devices, &pluginapi.CDIDevice{
+			Name: cdi.QualifiedName(c.resourceName(), deviceID),
+		})
+	}
+	return devices
+}
+
+// deviceEnvName returns the name of the environment variable holding the CPUs of a device, e.g. CPUSET_CORE_3.
+func (c *CPUSetDevicePluginDriver) deviceEnvName(deviceID string) string {
+	return envName("CPUSET", c.name, deviceID)
+}
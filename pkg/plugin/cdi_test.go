@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stefanaki/cpuset-plugin/pkg/cdi"
+	"github.com/stefanaki/cpuset-plugin/pkg/cpuview"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// newCDIDriver creates and starts a driver of the core resource writing its CDI spec and cpu view files
+// into the given directories, like the daemon does after every restart.
+func newCDIDriver(t *testing.T, cdiWriter *cdi.Writer, cpuView *cpuview.Generator) *CPUSetDevicePluginDriver {
+	t.Helper()
+	state, err := NewState(logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create state: %v", err)
+	}
+	resources, err := ParseResourcesConfig(Vendor, "core")
+	if err != nil {
+		t.Fatalf("failed to parse resources: %v", err)
+	}
+	driver, err := NewCPUSetDevicePluginDriver(Vendor, resources.Resources[0], state, DriverOptions{
+		CDI:              cdiWriter,
+		CPUView:          cpuView,
+		DevicePluginPath: t.TempDir(),
+	}, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create driver: %v", err)
+	}
+	if err := driver.Start(); err != nil {
+		t.Fatalf("failed to start driver: %v", err)
+	}
+	t.Cleanup(func() {
+		driver.Stop()
+	})
+	return driver
+}
+
+// specDevices returns the names of the devices of the CDI spec of the driver.
+func specDevices(t *testing.T, cdiWriter *cdi.Writer, driver *CPUSetDevicePluginDriver) map[string]struct{} {
+	t.Helper()
+	spec, err := cdiWriter.Read(driver.resourceName())
+	if err != nil || spec == nil {
+		t.Fatalf("failed to read CDI spec: %v", err)
+	}
+	devices := make(map[string]struct{}, len(spec.Devices))
+	for _, device := range spec.Devices {
+		devices[device.Name] = struct{}{}
+	}
+	return devices
+}
+
+func TestCDISpecSurvivesRestarts(t *testing.T) {
+	cdiWriter, err := cdi.NewWriter(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create CDI writer: %v", err)
+	}
+	cpuView, err := cpuview.NewGenerator(t.TempDir(), logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create cpu view generator: %v", err)
+	}
+
+	driver := newCDIDriver(t, cdiWriter, cpuView)
+	_, err = driver.Allocate(context.TODO(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"0"}}},
+	})
+	if err != nil {
+		t.Fatalf("failed to allocate core 0: %v", err)
+	}
+	viewDevice := cdiViewDevicePrefix + cpuview.Key(driver.resourceName(), []string{"0"})
+
+	// The spec is kept when the plugin is restarted by the supervisor.
+	if err := driver.Stop(); err != nil {
+		t.Fatalf("failed to stop driver: %v", err)
+	}
+	if _, ok := specDevices(t, cdiWriter, driver)["0"]; !ok {
+		t.Fatalf("CDI spec was removed when the plugin stopped")
+	}
+	if err := driver.Start(); err != nil {
+		t.Fatalf("failed to restart driver: %v", err)
+	}
+	if _, ok := specDevices(t, cdiWriter, driver)[viewDevice]; !ok {
+		t.Errorf("view device %s is missing after the plugin restarted", viewDevice)
+	}
+	driver.Stop()
+
+	// The view devices are restored from the spec when the daemon restarts.
+	restarted := newCDIDriver(t, cdiWriter, cpuView)
+	if _, ok := specDevices(t, cdiWriter, restarted)[viewDevice]; !ok {
+		t.Errorf("view device %s is missing after the daemon restarted", viewDevice)
+	}
+	restarted.Stop()
+
+	// The view devices of released allocations are pruned.
+	if err := cpuView.Remove(cpuview.Key(driver.resourceName(), []string{"0"})); err != nil {
+		t.Fatalf("failed to remove cpu view files: %v", err)
+	}
+	pruned := newCDIDriver(t, cdiWriter, cpuView)
+	devices := specDevices(t, cdiWriter, pruned)
+	if _, ok := devices[viewDevice]; ok {
+		t.Errorf("view device %s of a released allocation was not pruned", viewDevice)
+	}
+	if _, ok := devices["0"]; !ok {
+		t.Errorf("device 0 is missing from the CDI spec")
+	}
+}
+
+func TestAllocateRemovesViewsOnFailure(t *testing.T) {
+	cdiDir := t.TempDir()
+	cdiWriter, err := cdi.NewWriter(cdiDir)
+	if err != nil {
+		t.Fatalf("failed to create CDI writer: %v", err)
+	}
+	cpuView, err := cpuview.NewGenerator(t.TempDir(), logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create cpu view generator: %v", err)
+	}
+	driver := newCDIDriver(t, cdiWriter, cpuView)
+
+	// The CDI spec of the view files cannot be written once the spec directory is gone.
+	if err := os.RemoveAll(cdiDir); err != nil {
+		t.Fatalf("failed to remove CDI spec directory: %v", err)
+	}
+	_, err = driver.Allocate(context.TODO(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"0"}}},
+	})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("Allocate error = %v, want an Internal status", err)
+	}
+	if cpuView.Exists(cpuview.Key(driver.resourceName(), []string{"0"})) {
+		t.Errorf("cpu view files of a failed allocation were not removed")
+	}
+	if len(driver.state.GetReservations()) != 0 {
+		t.Errorf("reservations of a failed allocation were not released")
+	}
+}
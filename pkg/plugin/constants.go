@@ -9,11 +9,32 @@ const (
 	ResourceNameSocket ResourceName = "socket"
 	ResourceNameCore   ResourceName = "core"
 	ResourceNameCPU    ResourceName = "cpu"
+	ResourceNameShared ResourceName = "cpu-shared"
 )
 
+// ResourceNamePoolPrefix is the prefix of the resources serving the CPU pools.
+const ResourceNamePoolPrefix = "pool-"
+
 const (
 	SocketFileNUMA   = "numa.sock"
 	SocketFileSocket = "socket.sock"
 	SocketFileCore   = "core.sock"
 	SocketFileCPU    = "cpu.sock"
+	SocketFileShared = "cpu-shared.sock"
 )
+
+// resourceAllocationTypes maps every supported resource to the type of its allocations.
+var resourceAllocationTypes = map[ResourceName]AllocationType{
+	ResourceNameNUMA:   AllocationTypeNUMA,
+	ResourceNameSocket: AllocationTypeSocket,
+	ResourceNameCore:   AllocationTypeCore,
+	ResourceNameCPU:    AllocationTypeCPU,
+}
+
+// defaultSocketFiles maps every supported resource to its default socket file name.
+var defaultSocketFiles = map[ResourceName]string{
+	ResourceNameNUMA:   SocketFileNUMA,
+	ResourceNameSocket: SocketFileSocket,
+	ResourceNameCore:   SocketFileCore,
+	ResourceNameCPU:    SocketFileCPU,
+}
@@ -6,30 +6,74 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/stefanaki/cpuset-plugin/pkg/cdi"
+	"github.com/stefanaki/cpuset-plugin/pkg/cpuview"
+	"github.com/stefanaki/cpuset-plugin/pkg/health"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
+// DriverOptions holds the optional features of the device plugin drivers.
+type DriverOptions struct {
+	// CPUView generates the CPU view files mounted into containers, nil to disable.
+	CPUView *cpuview.Generator
+	// CDI writes the CDI spec files of the devices, nil to pass the allocations through environment variables.
+	CDI *cdi.Writer
+	// Health reports the health of the CPUs, nil to report every device as healthy.
+	Health *health.Checker
+	// RegistrationMode is the mechanism used to register with the kubelet.
+	RegistrationMode RegistrationMode
+	// PluginsRegistryPath is the directory watched by the kubelet plugin watcher.
+	PluginsRegistryPath string
+	// DevicePluginPath is the directory of the plugin sockets and of the kubelet registration socket.
+	DevicePluginPath string
+}
+
 type CPUSetDevicePluginDriver struct {
-	name           string
-	socketFile     string
-	grpcServer     *grpc.Server
-	allocationType AllocationType
-	state          *State
-	logger         logr.Logger
+	domain             string
+	name               string
+	socketFile         string
+	grpcServer         *grpc.Server
+	registrationServer *grpc.Server
+	allocationType     AllocationType
+	resource           ResourceConfig
+	state              *State
+	options            DriverOptions
+	cpuView            *cpuview.Generator
+	health             *health.Checker
+	// cdiViews holds the CDI mounts of the CPU view files of the allocations, keyed by view key.
+	cdiViews map[string][]cdi.Mount
+	cdiMutex sync.Mutex
+	logger   logr.Logger
 }
 
-func NewCPUSetDevicePluginDriver(name string, socketFile string, allocationType AllocationType, state *State, logger logr.Logger) (*CPUSetDevicePluginDriver, error) {
+func NewCPUSetDevicePluginDriver(domain string, resource ResourceConfig, state *State, options DriverOptions, logger logr.Logger) (*CPUSetDevicePluginDriver, error) {
+	if options.RegistrationMode == "" {
+		options.RegistrationMode = RegistrationModeKubelet
+	}
+	if options.PluginsRegistryPath == "" {
+		options.PluginsRegistryPath = DefaultPluginsRegistryPath
+	}
+	if options.DevicePluginPath == "" {
+		options.DevicePluginPath = pluginapi.DevicePluginPath
+	}
 	driver := &CPUSetDevicePluginDriver{
-		name:           name,
-		socketFile:     socketFile,
-		allocationType: allocationType,
+		domain:         domain,
+		name:           string(resource.Name),
+		socketFile:     resource.SocketFile,
+		allocationType: resource.AllocationType,
+		resource:       resource,
 		state:          state,
-		logger:         logger.WithName(fmt.Sprintf("device-%s", name)),
+		options:        options,
+		cpuView:        options.CPUView,
+		health:         options.Health,
+		cdiViews:       make(map[string][]cdi.Mount),
+		logger:         logger.WithName(fmt.Sprintf("device-%s", resource.Name)),
 	}
 	if err := driver.deleteExistingSocket(); err != nil {
 		return nil, fmt.Errorf("failed to delete existing socket: %v", err)
@@ -37,8 +81,12 @@ func NewCPUSetDevicePluginDriver(name string, socketFile string, allocationType
 	return driver, nil
 }
 
-func (c CPUSetDevicePluginDriver) Register() error {
-	conn, err := grpc.Dial(pluginapi.KubeletSocket, grpc.WithTransportCredentials(insecure.NewCredentials()),
+func (c *CPUSetDevicePluginDriver) Register() error {
+	if c.options.RegistrationMode == RegistrationModePluginWatcher {
+		return c.registerWithPluginWatcher()
+	}
+
+	conn, err := grpc.Dial(c.kubeletSocket(), grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
 			d := &net.Dialer{}
 			return d.DialContext(ctx, "unix", addr)
@@ -52,7 +100,7 @@ func (c CPUSetDevicePluginDriver) Register() error {
 	request := &pluginapi.RegisterRequest{
 		Version:      pluginapi.Version,
 		Endpoint:     c.socketFile,
-		ResourceName: fmt.Sprintf("%s/%s", Vendor, c.name),
+		ResourceName: c.resourceName(),
 	}
 
 	if _, err = client.Register(context.Background(), request); err != nil {
@@ -63,10 +111,20 @@ func (c CPUSetDevicePluginDriver) Register() error {
 	return nil
 }
 
-func (c CPUSetDevicePluginDriver) Start() error {
-	pluginEndpoint := filepath.Join(pluginapi.DevicePluginPath, c.socketFile)
+func (c *CPUSetDevicePluginDriver) Start() error {
+	pluginEndpoint := c.endpoint()
 	c.logger.Info("Starting CPU Device Plugin server", "endpoint", pluginEndpoint)
-	if err := os.Remove(c.socketFile); err != nil && !os.IsNotExist(err) {
+	if c.options.CDI != nil {
+		if err := c.loadCDIViews(); err != nil {
+			c.logger.Error(err, "Failed to read CDI spec")
+			return err
+		}
+		if err := c.writeCDISpec(); err != nil {
+			c.logger.Error(err, "Failed to write CDI spec")
+			return err
+		}
+	}
+	if err := c.deleteExistingSocket(); err != nil {
 		return fmt.Errorf("removing listening address: %v", err)
 	}
 	lis, err := net.Listen("unix", pluginEndpoint)
@@ -104,61 +162,63 @@ func (c CPUSetDevicePluginDriver) Start() error {
 	return nil
 }
 
-func (c CPUSetDevicePluginDriver) Stop() error {
+// Stop stops the plugin server. The CDI spec is kept, since containers allocated earlier resolve their CDI devices
+// whenever they are created or restarted, including while the plugin restarts.
+func (c *CPUSetDevicePluginDriver) Stop() error {
 	c.logger.Info("Stopping CPU Device Plugin server")
 	if c.grpcServer != nil {
 		c.grpcServer.Stop()
 		c.grpcServer = nil
 	}
+	if c.options.RegistrationMode == RegistrationModePluginWatcher {
+		c.stopRegistrationServer()
+		if err := c.deleteRegistrationSocket(); err != nil {
+			return err
+		}
+	}
 	return c.deleteExistingSocket()
 }
 
-func (c CPUSetDevicePluginDriver) deleteExistingSocket() error {
-	pluginEndpoint := filepath.Join(pluginapi.DevicePluginPath, c.socketFile)
-	if err := os.Remove(pluginEndpoint); err != nil && !os.IsNotExist(err) {
-		return err
-	}
-	return nil
+func (c *CPUSetDevicePluginDriver) resourceName() string {
+	return fmt.Sprintf("%s/%s", c.domain, c.name)
 }
 
-func CreatePluginsForResources(state *State, logger logr.Logger) ([]*CPUSetDevicePluginDriver, error) {
-	plugins := make([]*CPUSetDevicePluginDriver, 0)
+// endpoint returns the path of the plugin socket.
+func (c *CPUSetDevicePluginDriver) endpoint() string {
+	return filepath.Join(c.options.DevicePluginPath, c.socketFile)
+}
 
-	// Create NUMA plugin
-	numaPlugin, err := NewCPUSetDevicePluginDriver(string(ResourceNameNUMA), SocketFileNUMA, AllocationTypeNUMA, state, logger)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create plugins: %v", err)
-	}
-	plugins = append(plugins, numaPlugin)
+// kubeletSocket returns the path of the kubelet registration socket.
+func (c *CPUSetDevicePluginDriver) kubeletSocket() string {
+	return KubeletSocket(c.options.DevicePluginPath)
+}
 
-	// Create Socket plugin
-	socketPlugin, err := NewCPUSetDevicePluginDriver(string(ResourceNameSocket), SocketFileSocket, AllocationTypeSocket, state, logger)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create plugins: %v", err)
-	}
-	plugins = append(plugins, socketPlugin)
+// KubeletSocket returns the path of the kubelet registration socket in the device plugins directory.
+func KubeletSocket(devicePluginPath string) string {
+	return filepath.Join(devicePluginPath, filepath.Base(pluginapi.KubeletSocket))
+}
 
-	// Create Core plugin
-	corePlugin, err := NewCPUSetDevicePluginDriver(string(ResourceNameCore), SocketFileCore, AllocationTypeCore, state, logger)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create plugins: %v", err)
-	}
-	plugins = append(plugins, corePlugin)
+func (c *CPUSetDevicePluginDriver) socketExists() bool {
+	_, err := os.Stat(c.endpoint())
+	return err == nil
+}
 
-	// Create CPU plugin
-	cpuPlugin, err := NewCPUSetDevicePluginDriver(string(ResourceNameCPU), SocketFileCPU, AllocationTypeCPU, state, logger)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create plugins: %v", err)
+func (c *CPUSetDevicePluginDriver) deleteExistingSocket() error {
+	if err := os.Remove(c.endpoint()); err != nil && !os.IsNotExist(err) {
+		return err
 	}
-	plugins = append(plugins, cpuPlugin)
+	return nil
+}
 
-	for _, plugin := range plugins {
-		if err := plugin.Start(); err != nil {
-			return nil, fmt.Errorf("failed to start plugin: %v", err)
-		}
-		if err := plugin.Register(); err != nil {
-			return nil, fmt.Errorf("failed to register plugin: %v", err)
+func CreatePluginsForResources(resources ResourcesConfig, state *State, options DriverOptions, logger logr.Logger) ([]*CPUSetDevicePluginDriver, error) {
+	plugins := make([]*CPUSetDevicePluginDriver, 0)
+
+	for _, resource := range resources.Resources {
+		plugin, err := NewCPUSetDevicePluginDriver(resources.Domain, resource, state, options, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create plugins: %v", err)
 		}
+		plugins = append(plugins, plugin)
 	}
 
 	return plugins, nil
@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stefanaki/cpuset-plugin/pkg/kubelettest"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"k8s.io/utils/cpuset"
+)
+
+// waitForHealth waits until the plugin of a resource advertises a device with the given health.
+func waitForHealth(t *testing.T, kubelet *kubelettest.Kubelet, resourceName string, deviceID string, health string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, device := range kubelet.Devices(resourceName) {
+			if device.GetID() == deviceID && device.GetHealth() == health {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("device %s of %s was not reported %s", deviceID, resourceName, health)
+}
+
+func TestDevicePluginLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	kubelet := kubelettest.NewKubelet(dir)
+	if err := kubelet.Start(); err != nil {
+		t.Fatalf("failed to start kubelet: %v", err)
+	}
+	defer kubelet.Stop()
+
+	state, err := NewState(logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create state: %v", err)
+	}
+	resources, err := ParseResourcesConfig(Vendor, "core,cpu")
+	if err != nil {
+		t.Fatalf("failed to parse resources: %v", err)
+	}
+	plugins, err := CreatePluginsForResources(resources, state, DriverOptions{DevicePluginPath: dir}, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create plugins: %v", err)
+	}
+	supervisor := NewSupervisor(plugins, dir, logr.Discard())
+	stopCh := make(chan struct{})
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- supervisor.Run(stopCh)
+	}()
+	defer func() {
+		close(stopCh)
+		if err := <-doneCh; err != nil {
+			t.Errorf("supervisor failed: %v", err)
+		}
+	}()
+
+	coreResource := resources.FullName(ResourceNameCore)
+	cpuResource := resources.FullName(ResourceNameCPU)
+	coreCPUs := cpuset.New(state.Topology.GetAllCPUsInCore(0)...)
+	firstCPU := coreCPUs.List()[0]
+	if _, err := kubelet.WaitForDevices(coreResource, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubelet.WaitForDevices(cpuResource, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitForHealth(t, kubelet, cpuResource, cpuset.New(firstCPU).String(), pluginapi.Healthy)
+
+	response, err := kubelet.Allocate(coreResource, "0")
+	if err != nil {
+		t.Fatalf("failed to allocate core 0: %v", err)
+	}
+	if got := response.GetEnvs()["CPUSET_CORE"]; got != coreCPUs.String() {
+		t.Errorf("CPUSET_CORE = %q, want %q", got, coreCPUs.String())
+	}
+	if got := response.GetEnvs()["CPUSET"]; got != coreCPUs.String() {
+		t.Errorf("CPUSET = %q, want %q", got, coreCPUs.String())
+	}
+	// The CPUs of the allocated core are reported unhealthy by the cpu resource through ListAndWatch.
+	waitForHealth(t, kubelet, cpuResource, cpuset.New(firstCPU).String(), pluginapi.Unhealthy)
+	if _, err := kubelet.Allocate(cpuResource, cpuset.New(firstCPU).String()); err == nil {
+		t.Errorf("allocated a cpu of an allocated core")
+	}
+
+	// The plugins are registered again when the kubelet restarts.
+	kubelet.Stop()
+	if err := kubelet.Start(); err != nil {
+		t.Fatalf("failed to restart kubelet: %v", err)
+	}
+	if _, err := kubelet.WaitForDevices(coreResource, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
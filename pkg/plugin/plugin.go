@@ -2,21 +2,32 @@ package plugin
 
 import (
 	"context"
-	"golang.org/x/exp/maps"
+	"github.com/stefanaki/cpuset-plugin/pkg/cpuview"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 	"k8s.io/utils/cpuset"
-	"strconv"
+	"strings"
 	"time"
 )
 
-func (c CPUSetDevicePluginDriver) GetDevicePluginOptions(ctx context.Context, empty *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+func (c *CPUSetDevicePluginDriver) GetDevicePluginOptions(ctx context.Context, empty *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
 	return &pluginapi.DevicePluginOptions{
 		PreStartRequired:                false,
 		GetPreferredAllocationAvailable: false,
 	}, nil
 }
 
-func (c CPUSetDevicePluginDriver) ListAndWatch(empty *pluginapi.Empty, server pluginapi.DevicePlugin_ListAndWatchServer) error {
+func (c *CPUSetDevicePluginDriver) ListAndWatch(empty *pluginapi.Empty, server pluginapi.DevicePlugin_ListAndWatchServer) error {
+	var healthUpdates <-chan struct{}
+	if c.health != nil {
+		updates, cancel := c.health.Subscribe()
+		defer cancel()
+		healthUpdates = updates
+	}
+	// Allocations released or made by the controller change the health of the devices overlapping them.
+	stateUpdates, cancelStateUpdates := c.state.Subscribe()
+	defer cancelStateUpdates()
 	for {
 		response := &pluginapi.ListAndWatchResponse{
 			Devices: make([]*pluginapi.Device, 0),
@@ -24,69 +35,164 @@ func (c CPUSetDevicePluginDriver) ListAndWatch(empty *pluginapi.Empty, server pl
 		allocatableResources := c.getPluginResources()
 		for _, res := range allocatableResources {
 			response.Devices = append(response.Devices, &pluginapi.Device{
-				ID:     strconv.Itoa(res),
-				Health: pluginapi.Healthy,
+				ID:     res,
+				Health: c.getDeviceHealth(res),
 			})
 		}
 		if err := server.Send(response); err != nil {
 			return err
 		}
-		time.Sleep(2 * time.Second)
+		select {
+		case <-time.After(2 * time.Second):
+		case <-healthUpdates:
+		case <-stateUpdates:
+		case <-server.Context().Done():
+			return nil
+		}
 	}
 }
 
-func (c CPUSetDevicePluginDriver) Allocate(ctx context.Context, request *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+func (c *CPUSetDevicePluginDriver) Allocate(ctx context.Context, request *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
 	response := &pluginapi.AllocateResponse{}
+	reserved := make([]string, 0, len(request.ContainerRequests))
+	// The reservations and the cpu view files created by this call are removed if it fails.
+	written := make([]string, 0, len(request.ContainerRequests))
+	rollback := func() {
+		for _, key := range reserved {
+			c.state.ReleaseReservation(key)
+		}
+		for _, key := range written {
+			if err := c.cpuView.Remove(key); err != nil {
+				c.logger.Error(err, "Failed to remove cpu view files", "key", key)
+			}
+		}
+	}
 	for _, containerRequests := range request.ContainerRequests {
 		deviceIDs := containerRequests.DevicesIDs
 		cpus := cpuset.New()
 		for _, deviceID := range deviceIDs {
-			id, _ := strconv.Atoi(deviceID)
-			cpus = cpus.Union(c.getCPUSetForDevice(id))
+			deviceCPUs, err := c.resource.CPUsForDevice(c.state.Topology, deviceID)
+			if err != nil {
+				rollback()
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			cpus = cpus.Union(deviceCPUs)
 		}
-		containerEnv := make(map[string]string)
-		containerEnv["CPUSET"] = cpus.String()
-		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerAllocateResponse{
-			Envs: containerEnv,
+
+		key := ReservationKey(c.resourceName(), deviceIDs)
+		err := c.state.Reserve(key, Allocation{
+			CPUs:    cpus.String(),
+			Type:    c.allocationType,
+			Devices: map[string][]string{c.resourceName(): deviceIDs},
 		})
+		if err != nil {
+			rollback()
+			c.logger.Error(err, "Rejected allocation", "devices", deviceIDs)
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		reserved = append(reserved, key)
+		containerResponse := &pluginapi.ContainerAllocateResponse{}
+		if c.options.CDI != nil {
+			containerResponse.CDIDevices = c.cdiDevices(deviceIDs)
+		} else {
+			// The kubelet merges the environment variables of all the resources of the container, keeping the first
+			// value of a name, so CPUSET only holds the full set of single-resource containers. Every resource also
+			// exposes its own part of the combined set, e.g. CPUSET_CORE, and the controller publishes the combined set
+			// in the placement annotation and the cpu view files once the container is pinned.
+			containerResponse.Envs = map[string]string{
+				"CPUSET":                  cpus.String(),
+				envName("CPUSET", c.name): cpus.String(),
+			}
+		}
+		if c.cpuView != nil {
+			viewKey := cpuview.Key(c.resourceName(), deviceIDs)
+			// The view files of a repeated Allocate call may be mounted already, and are only removed with their allocation.
+			if !c.cpuView.Exists(viewKey) {
+				written = append(written, viewKey)
+			}
+			files, err := c.cpuView.Write(viewKey, cpus)
+			if err != nil {
+				rollback()
+				c.logger.Error(err, "Failed to write cpu view files", "cpus", cpus.String())
+				return nil, status.Errorf(codes.Internal, "failed to write cpu view files: %v", err)
+			}
+			if c.options.CDI != nil {
+				device, err := c.addCDIView(viewKey, files)
+				if err != nil {
+					rollback()
+					c.logger.Error(err, "Failed to write CDI spec of cpu view files", "cpus", cpus.String())
+					return nil, status.Errorf(codes.Internal, "failed to write CDI spec of cpu view files: %v", err)
+				}
+				containerResponse.CDIDevices = append(containerResponse.CDIDevices, device)
+			} else {
+				for _, file := range files {
+					containerResponse.Mounts = append(containerResponse.Mounts, &pluginapi.Mount{
+						ContainerPath: file.ContainerPath,
+						HostPath:      file.HostPath,
+						ReadOnly:      true,
+					})
+				}
+			}
+		}
+		response.ContainerResponses = append(response.ContainerResponses, containerResponse)
 	}
 	return response, nil
 }
 
-func (c CPUSetDevicePluginDriver) PreStartContainer(ctx context.Context, request *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+func (c *CPUSetDevicePluginDriver) PreStartContainer(ctx context.Context, request *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
 	//TODO implement me
 	panic("implement me")
 }
 
-func (c CPUSetDevicePluginDriver) GetPreferredAllocation(ctx context.Context, request *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+func (c *CPUSetDevicePluginDriver) GetPreferredAllocation(ctx context.Context, request *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
 	// TODO infer the preferred allocation from the state of the plugin
 	return &pluginapi.PreferredAllocationResponse{}, nil
 }
 
-func (c CPUSetDevicePluginDriver) getPluginResources() []int {
-	switch c.allocationType {
-	case AllocationTypeNUMA:
-		return maps.Keys(c.state.GetAvailableResources()[ResourceNameNUMA])
-	case AllocationTypeSocket:
-		return maps.Keys(c.state.GetAvailableResources()[ResourceNameSocket])
-	case AllocationTypeCore:
-		return maps.Keys(c.state.GetAvailableResources()[ResourceNameCore])
-	case AllocationTypeCPU:
-		return maps.Keys(c.state.GetAvailableResources()[ResourceNameCPU])
+// getPluginResources returns every device of the plugin, whether it is in use or not,
+// so that the capacity advertised to the kubelet stays stable.
+// Devices of the generic resources overlapping the CPUs of a pool or the shared CPUs are not served.
+func (c *CPUSetDevicePluginDriver) getPluginResources() []string {
+	devices := c.resource.DeviceIDs(c.state.Topology)
+	if c.allocationType == AllocationTypePool || c.allocationType == AllocationTypeShared {
+		return devices
 	}
-	return []int{}
+
+	reservedCPUs := c.state.GetReservedCPUs()
+	resources := make([]string, 0, len(devices))
+	for _, device := range devices {
+		if c.getCPUSetForDevice(device).Intersection(reservedCPUs).IsEmpty() {
+			resources = append(resources, device)
+		}
+	}
+	return resources
 }
 
-func (c CPUSetDevicePluginDriver) getCPUSetForDevice(deviceID int) cpuset.CPUSet {
-	switch c.allocationType {
-	case AllocationTypeNUMA:
-		return cpuset.New(c.state.Topology.GetAllCPUsInNUMA(deviceID)...)
-	case AllocationTypeSocket:
-		return cpuset.New(c.state.Topology.GetAllCPUsInSocket(deviceID)...)
-	case AllocationTypeCore:
-		return cpuset.New(c.state.Topology.GetAllCPUsInCore(deviceID)...)
-	case AllocationTypeCPU:
-		return cpuset.New(deviceID)
+// getDeviceHealth reports a device as unhealthy when any of its CPUs is unhealthy,
+// or when any of its CPUs is allocated through another resource type.
+func (c *CPUSetDevicePluginDriver) getDeviceHealth(deviceID string) string {
+	cpus := c.getCPUSetForDevice(deviceID)
+	if c.health != nil && !c.health.IsHealthy(cpus) {
+		return pluginapi.Unhealthy
 	}
-	return cpuset.New()
+	if c.state.IsUsedByOtherAllocationType(cpus, c.allocationType) {
+		return pluginapi.Unhealthy
+	}
+	return pluginapi.Healthy
+}
+
+func (c *CPUSetDevicePluginDriver) getCPUSetForDevice(deviceID string) cpuset.CPUSet {
+	cpus, _ := c.resource.CPUsForDevice(c.state.Topology, deviceID)
+	return cpus
+}
+
+// envName joins the parts into an environment variable name, e.g. CPUSET_CPU_SHARED.
+func envName(parts ...string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.Join(parts, "_"))
+	return strings.ToUpper(name)
 }
@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// RegistrationMode is the mechanism used to register the device plugins with the kubelet.
+type RegistrationMode string
+
+const (
+	// RegistrationModeKubelet registers the plugins by calling the Registration service on the kubelet socket.
+	RegistrationModeKubelet RegistrationMode = "kubelet"
+	// RegistrationModePluginWatcher serves the pluginregistration Registration service on a socket in the
+	// plugins registry directory, where it is discovered by the kubelet plugin watcher.
+	RegistrationModePluginWatcher RegistrationMode = "plugin-watcher"
+)
+
+// DefaultPluginsRegistryPath is the directory watched by the kubelet plugin watcher.
+const DefaultPluginsRegistryPath = "/var/lib/kubelet/plugins_registry"
+
+// registrationTimeout is how long to wait for the kubelet plugin watcher to report the registration status.
+const registrationTimeout = 30 * time.Second
+
+// ParseRegistrationMode parses the registration mode string and returns the corresponding RegistrationMode.
+func ParseRegistrationMode(mode string) (RegistrationMode, error) {
+	switch RegistrationMode(mode) {
+	case RegistrationModeKubelet, RegistrationModePluginWatcher:
+		return RegistrationMode(mode), nil
+	}
+	return "", fmt.Errorf("unknown registration mode: %s, supported values are: kubelet, plugin-watcher", mode)
+}
+
+// registrationHandler serves the pluginregistration Registration service of a device plugin.
+type registrationHandler struct {
+	driver *CPUSetDevicePluginDriver
+	status chan *registerapi.RegistrationStatus
+}
+
+func (h *registrationHandler) GetInfo(ctx context.Context, request *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	return &registerapi.PluginInfo{
+		Type:              registerapi.DevicePlugin,
+		Name:              h.driver.resourceName(),
+		Endpoint:          h.driver.endpoint(),
+		SupportedVersions: []string{pluginapi.Version},
+	}, nil
+}
+
+func (h *registrationHandler) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	select {
+	case h.status <- status:
+	default:
+	}
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
+
+// registerWithPluginWatcher serves the Registration service in the plugins registry directory and waits
+// until the kubelet plugin watcher reports the registration status.
+func (c *CPUSetDevicePluginDriver) registerWithPluginWatcher() error {
+	c.stopRegistrationServer()
+
+	registrationEndpoint := c.registrationEndpoint()
+	if err := os.MkdirAll(filepath.Dir(registrationEndpoint), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(registrationEndpoint); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing registration socket: %v", err)
+	}
+	lis, err := net.Listen("unix", registrationEndpoint)
+	if err != nil {
+		c.logger.Error(err, "Starting registration server failed")
+		return err
+	}
+
+	handler := &registrationHandler{
+		driver: c,
+		status: make(chan *registerapi.RegistrationStatus, 1),
+	}
+	c.registrationServer = grpc.NewServer()
+	registerapi.RegisterRegistrationServer(c.registrationServer, handler)
+	go func(server *grpc.Server) {
+		if err := server.Serve(lis); err != nil {
+			c.logger.Error(err, "Registration server failed")
+		}
+	}(c.registrationServer)
+	c.logger.Info("Waiting for the kubelet plugin watcher", "endpoint", registrationEndpoint)
+
+	select {
+	case status := <-handler.status:
+		if !status.PluginRegistered {
+			return fmt.Errorf("kubelet rejected plugin registration: %s", status.Error)
+		}
+	case <-time.After(registrationTimeout):
+		return fmt.Errorf("timed out waiting for the kubelet plugin watcher")
+	}
+	c.logger.Info("CPU Device Plugin registered to Kubelet through the plugin watcher")
+	return nil
+}
+
+func (c *CPUSetDevicePluginDriver) stopRegistrationServer() {
+	if c.registrationServer != nil {
+		c.registrationServer.Stop()
+		c.registrationServer = nil
+	}
+}
+
+// registrationEndpoint returns the path of the Registration service socket in the plugins registry directory.
+func (c *CPUSetDevicePluginDriver) registrationEndpoint() string {
+	name := strings.ReplaceAll(c.resourceName(), "/", "_")
+	return filepath.Join(c.options.PluginsRegistryPath, fmt.Sprintf("%s.sock", name))
+}
+
+func (c *CPUSetDevicePluginDriver) deleteRegistrationSocket() error {
+	if err := os.Remove(c.registrationEndpoint()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stefanaki/cpuset-plugin/pkg/kubelettest"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// newPluginWatcherDriver creates a driver of the core resource registering through the plugin watcher,
+// with its sockets in temporary directories.
+func newPluginWatcherDriver(t *testing.T, registryPath string) *CPUSetDevicePluginDriver {
+	t.Helper()
+	state, err := NewState(logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create state: %v", err)
+	}
+	resources, err := ParseResourcesConfig(Vendor, "core")
+	if err != nil {
+		t.Fatalf("failed to parse resources: %v", err)
+	}
+	driver, err := NewCPUSetDevicePluginDriver(Vendor, resources.Resources[0], state, DriverOptions{
+		RegistrationMode:    RegistrationModePluginWatcher,
+		PluginsRegistryPath: registryPath,
+		DevicePluginPath:    t.TempDir(),
+	}, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create driver: %v", err)
+	}
+	if err := driver.Start(); err != nil {
+		t.Fatalf("failed to start driver: %v", err)
+	}
+	t.Cleanup(func() {
+		driver.Stop()
+	})
+	return driver
+}
+
+func TestRegisterWithPluginWatcher(t *testing.T) {
+	registryPath := t.TempDir()
+	watcher := kubelettest.NewRegistryWatcher(registryPath)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go watcher.Run(stopCh)
+
+	driver := newPluginWatcherDriver(t, registryPath)
+	if err := driver.Register(); err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+
+	info, err := watcher.WaitForPlugin(driver.resourceName(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != registerapi.DevicePlugin {
+		t.Errorf("plugin type = %s, want %s", info.Type, registerapi.DevicePlugin)
+	}
+	if info.Endpoint != driver.endpoint() {
+		t.Errorf("plugin endpoint = %s, want %s", info.Endpoint, driver.endpoint())
+	}
+	if len(info.SupportedVersions) != 1 || info.SupportedVersions[0] != pluginapi.Version {
+		t.Errorf("supported versions = %v, want [%s]", info.SupportedVersions, pluginapi.Version)
+	}
+}
+
+func TestRegisterWithPluginWatcherRejected(t *testing.T) {
+	registryPath := t.TempDir()
+	watcher := kubelettest.NewRegistryWatcher(registryPath)
+	watcher.Validate = func(info *registerapi.PluginInfo) error {
+		return errors.New("unsupported version")
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go watcher.Run(stopCh)
+
+	driver := newPluginWatcherDriver(t, registryPath)
+	err := driver.Register()
+	if err == nil {
+		t.Fatal("registration succeeded, want the rejection reported by the plugin watcher")
+	}
+	if !strings.Contains(err.Error(), "unsupported version") {
+		t.Errorf("registration error = %v, want the rejection reason", err)
+	}
+	if _, ok := watcher.Plugins()[driver.resourceName()]; ok {
+		t.Errorf("rejected plugin is registered")
+	}
+}
@@ -0,0 +1,324 @@
+package plugin
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/stefanaki/cpuset-plugin/pkg/topology"
+	"golang.org/x/exp/maps"
+	"k8s.io/apimachinery/pkg/util/validation"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"k8s.io/utils/cpuset"
+)
+
+// ResourceConfig describes a device plugin resource to register with the kubelet.
+type ResourceConfig struct {
+	Name           ResourceName
+	SocketFile     string
+	AllocationType AllocationType
+	// CPUs is the set of CPUs of a pool or shared resource.
+	CPUs cpuset.CPUSet
+	// Exclusive is true if the CPUs of a pool resource are allocated exclusively.
+	// Containers requesting a non-exclusive pool are pinned to all the CPUs of the pool.
+	Exclusive bool
+	// Replicas is the number of devices advertised per CPU of a shared resource.
+	Replicas int
+}
+
+// DeviceIDs returns the IDs of all the devices of the resource.
+func (r ResourceConfig) DeviceIDs(t *topology.Topology) []string {
+	var ids []int
+	switch r.AllocationType {
+	case AllocationTypeNUMA:
+		ids = maps.Keys(t.NUMATopology.Nodes)
+	case AllocationTypeSocket:
+		ids = maps.Keys(t.CPUTopology.Sockets)
+	case AllocationTypeCore:
+		for _, socket := range t.CPUTopology.Sockets {
+			ids = append(ids, maps.Keys(socket.Cores)...)
+		}
+	case AllocationTypeCPU:
+		ids = t.GetAllCPUs()
+	case AllocationTypePool:
+		ids = r.CPUs.List()
+	case AllocationTypeShared:
+		deviceIDs := make([]string, 0, r.CPUs.Size()*r.Replicas)
+		for _, cpu := range r.CPUs.List() {
+			for replica := 0; replica < r.Replicas; replica++ {
+				deviceIDs = append(deviceIDs, fmt.Sprintf("%d-%d", cpu, replica))
+			}
+		}
+		return deviceIDs
+	}
+
+	deviceIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		deviceIDs = append(deviceIDs, strconv.Itoa(id))
+	}
+	return deviceIDs
+}
+
+// CPUsForDevice returns the CPUs a container is pinned to when it is allocated a device of the resource.
+func (r ResourceConfig) CPUsForDevice(t *topology.Topology, deviceID string) (cpuset.CPUSet, error) {
+	if r.AllocationType == AllocationTypeShared {
+		// Shared devices are slots of a CPU, identified as <cpu>-<replica>.
+		cpu, replica, found := strings.Cut(deviceID, "-")
+		id, err := strconv.Atoi(cpu)
+		if err != nil || !found || !r.CPUs.Contains(id) {
+			return cpuset.New(), fmt.Errorf("invalid device ID %q of resource %s", deviceID, r.Name)
+		}
+		if n, err := strconv.Atoi(replica); err != nil || n < 0 || n >= r.Replicas {
+			return cpuset.New(), fmt.Errorf("invalid device ID %q of resource %s", deviceID, r.Name)
+		}
+		return cpuset.New(id), nil
+	}
+	id, err := strconv.Atoi(deviceID)
+	if err != nil {
+		return cpuset.New(), fmt.Errorf("invalid device ID %q of resource %s", deviceID, r.Name)
+	}
+
+	switch r.AllocationType {
+	case AllocationTypeNUMA:
+		return cpuset.New(t.GetAllCPUsInNUMA(id)...), nil
+	case AllocationTypeSocket:
+		return cpuset.New(t.GetAllCPUsInSocket(id)...), nil
+	case AllocationTypeCore:
+		return cpuset.New(t.GetAllCPUsInCore(id)...), nil
+	case AllocationTypePool:
+		if !r.Exclusive {
+			return r.CPUs, nil
+		}
+		return cpuset.New(id), nil
+	}
+	return cpuset.New(id), nil
+}
+
+// IsExclusive reports whether every device of the resource is allocated to a single container.
+// The devices of shared resources and of non-exclusive pools share their CPUs.
+func (r ResourceConfig) IsExclusive() bool {
+	switch r.AllocationType {
+	case AllocationTypeShared:
+		return false
+	case AllocationTypePool:
+		return r.Exclusive
+	}
+	return true
+}
+
+// ResourcesConfig describes the set of resources to register and the domain they are registered under.
+type ResourcesConfig struct {
+	Domain    string
+	Resources []ResourceConfig
+}
+
+// ParseResourcesConfig parses a comma separated list of resources, each optionally followed by
+// the name of its socket file, e.g. "core=my-core.sock,cpu".
+func ParseResourcesConfig(domain string, resources string) (ResourcesConfig, error) {
+	if domain == "" {
+		return ResourcesConfig{}, fmt.Errorf("resource domain must not be empty")
+	}
+	config := ResourcesConfig{
+		Domain:    domain,
+		Resources: make([]ResourceConfig, 0),
+	}
+	seen := make(map[ResourceName]struct{})
+	for _, entry := range strings.Split(resources, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, socketFile, _ := strings.Cut(entry, "=")
+		resourceName := ResourceName(name)
+		allocationType, ok := resourceAllocationTypes[resourceName]
+		if !ok {
+			return ResourcesConfig{}, fmt.Errorf("unknown resource: %s, supported resources are: numa, socket, core, cpu", name)
+		}
+		if _, ok := seen[resourceName]; ok {
+			return ResourcesConfig{}, fmt.Errorf("resource %s is specified more than once", name)
+		}
+		seen[resourceName] = struct{}{}
+		if socketFile == "" {
+			socketFile = defaultSocketFiles[resourceName]
+		}
+		if err := config.validateSocketFile(socketFile); err != nil {
+			return ResourcesConfig{}, err
+		}
+		config.Resources = append(config.Resources, ResourceConfig{
+			Name:           resourceName,
+			SocketFile:     socketFile,
+			AllocationType: allocationType,
+		})
+	}
+	if len(config.Resources) == 0 {
+		return ResourcesConfig{}, fmt.Errorf("at least one resource must be specified")
+	}
+	return config, nil
+}
+
+// AddPool adds a resource serving the CPUs of a pool.
+// The CPUs of a pool must not overlap with the CPUs of another pool.
+func (r *ResourcesConfig) AddPool(name string, cpus string, exclusive bool) error {
+	poolCPUs, err := cpuset.Parse(cpus)
+	if err != nil {
+		return fmt.Errorf("failed to parse CPUs of pool %s: %v", name, err)
+	}
+	if poolCPUs.IsEmpty() {
+		return fmt.Errorf("pool %s has no CPUs", name)
+	}
+	if !r.PoolCPUs().Intersection(poolCPUs).IsEmpty() {
+		return fmt.Errorf("CPUs of pool %s overlap with another pool", name)
+	}
+	resourceName := ResourceName(ResourceNamePoolPrefix + name)
+	if errs := validation.IsQualifiedName(r.FullName(resourceName)); len(errs) > 0 {
+		return fmt.Errorf("invalid pool name %q: %s", name, strings.Join(errs, ", "))
+	}
+	for _, resource := range r.Resources {
+		if resource.Name == resourceName {
+			return fmt.Errorf("pool %s is specified more than once", name)
+		}
+	}
+	socketFile := fmt.Sprintf("%s.sock", resourceName)
+	if err := r.validateSocketFile(socketFile); err != nil {
+		return err
+	}
+	r.Resources = append(r.Resources, ResourceConfig{
+		Name:           resourceName,
+		SocketFile:     socketFile,
+		AllocationType: AllocationTypePool,
+		CPUs:           poolCPUs,
+		Exclusive:      exclusive,
+	})
+	return nil
+}
+
+// AddShared adds a resource advertising the given number of non-exclusive devices per CPU of the shared set.
+func (r *ResourcesConfig) AddShared(cpus string, replicas int) error {
+	sharedCPUs, err := cpuset.Parse(cpus)
+	if err != nil {
+		return fmt.Errorf("failed to parse shared CPUs: %v", err)
+	}
+	if sharedCPUs.IsEmpty() {
+		return fmt.Errorf("no shared CPUs specified")
+	}
+	if replicas < 1 {
+		return fmt.Errorf("shared CPU replicas must be at least 1")
+	}
+	if !r.PoolCPUs().Intersection(sharedCPUs).IsEmpty() {
+		return fmt.Errorf("shared CPUs overlap with the CPUs of a pool")
+	}
+	if err := r.validateSocketFile(SocketFileShared); err != nil {
+		return err
+	}
+	r.Resources = append(r.Resources, ResourceConfig{
+		Name:           ResourceNameShared,
+		SocketFile:     SocketFileShared,
+		AllocationType: AllocationTypeShared,
+		CPUs:           sharedCPUs,
+		Replicas:       replicas,
+	})
+	return nil
+}
+
+// validateSocketFile checks that a socket file name is a single path element of the device plugins directory,
+// which is not the kubelet socket or the socket of another resource.
+func (r ResourcesConfig) validateSocketFile(socketFile string) error {
+	if socketFile == "." || socketFile == ".." || socketFile != filepath.Base(socketFile) {
+		return fmt.Errorf("invalid socket file name: %s", socketFile)
+	}
+	if socketFile == filepath.Base(pluginapi.KubeletSocket) {
+		return fmt.Errorf("socket file name %s is reserved for the kubelet", socketFile)
+	}
+	for _, resource := range r.Resources {
+		if resource.SocketFile == socketFile {
+			return fmt.Errorf("socket file %s is already used by resource %s", socketFile, resource.Name)
+		}
+	}
+	return nil
+}
+
+// PoolCPUs returns the union of the CPUs of all pools.
+func (r ResourcesConfig) PoolCPUs() cpuset.CPUSet {
+	return r.cpusOfType(AllocationTypePool)
+}
+
+// SharedCPUs returns the CPUs of the shared resource.
+func (r ResourcesConfig) SharedCPUs() cpuset.CPUSet {
+	return r.cpusOfType(AllocationTypeShared)
+}
+
+// ReservedCPUs returns the CPUs of the pools and of the shared resource, which are excluded from the generic resources.
+func (r ResourcesConfig) ReservedCPUs() cpuset.CPUSet {
+	return r.PoolCPUs().Union(r.SharedCPUs())
+}
+
+func (r ResourcesConfig) cpusOfType(allocationType AllocationType) cpuset.CPUSet {
+	cpus := cpuset.New()
+	for _, resource := range r.Resources {
+		if resource.AllocationType == allocationType {
+			cpus = cpus.Union(resource.CPUs)
+		}
+	}
+	return cpus
+}
+
+// FullName returns the fully qualified name of a resource, e.g. stefanaki.github.com/core.
+func (r ResourcesConfig) FullName(name ResourceName) string {
+	return fmt.Sprintf("%s/%s", r.Domain, name)
+}
+
+// IsManaged reports whether a fully qualified resource name belongs to the configured domain.
+func (r ResourcesConfig) IsManaged(resourceName string) bool {
+	return strings.HasPrefix(resourceName, r.Domain+"/")
+}
+
+// Lookup returns the configuration of a fully qualified resource name.
+func (r ResourcesConfig) Lookup(resourceName string) (ResourceConfig, bool) {
+	for _, resource := range r.Resources {
+		if r.FullName(resource.Name) == resourceName {
+			return resource, true
+		}
+	}
+	return ResourceConfig{}, false
+}
+
+// AllocationForDevices returns the combined allocation of the devices of several resources, keyed by resource name.
+// Devices of resources that are not configured are ignored.
+func (r ResourcesConfig) AllocationForDevices(t *topology.Topology, devices map[string][]string) (Allocation, error) {
+	cpus := cpuset.New()
+	cpusByType := make(map[AllocationType]cpuset.CPUSet)
+	managedDevices := make(map[string][]string)
+	for resourceName, deviceIDs := range devices {
+		resource, ok := r.Lookup(resourceName)
+		if !ok {
+			continue
+		}
+		for _, deviceID := range deviceIDs {
+			deviceCPUs, err := resource.CPUsForDevice(t, deviceID)
+			if err != nil {
+				return Allocation{}, err
+			}
+			cpus = cpus.Union(deviceCPUs)
+			cpusByType[resource.AllocationType] = deviceCPUs.Union(cpusByType[resource.AllocationType])
+		}
+		managedDevices[resourceName] = deviceIDs
+	}
+
+	allocation := Allocation{
+		CPUs:    cpus.String(),
+		Devices: managedDevices,
+	}
+	switch len(cpusByType) {
+	case 0:
+	case 1:
+		allocation.Type = maps.Keys(cpusByType)[0]
+	default:
+		allocation.Type = AllocationTypeCombined
+		allocation.CPUsByType = make(map[AllocationType]string, len(cpusByType))
+		for allocationType, typeCPUs := range cpusByType {
+			allocation.CPUsByType[allocationType] = typeCPUs.String()
+		}
+	}
+	return allocation, nil
+}
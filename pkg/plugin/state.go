@@ -3,119 +3,234 @@ package plugin
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/go-logr/logr"
 	"github.com/stefanaki/cpuset-plugin/pkg/topology"
 	"golang.org/x/exp/maps"
 	"k8s.io/utils/cpuset"
 	"os"
 	"sync"
+	"time"
 )
 
 type State struct {
-	Allocations        map[string]Allocation             `json:"allocations"`
-	Topology           *topology.Topology                `json:"topology"`
-	AvailableResources map[ResourceName]map[int]struct{} `json:"availableResources"`
-	mutex              sync.Mutex
+	Allocations  map[string]Allocation  `json:"allocations"`
+	Topology     *topology.Topology     `json:"topology"`
+	ReservedCPUs string                 `json:"reservedCPUs"`
+	Reservations map[string]Reservation `json:"reservations"`
+	subscribers  map[chan struct{}]struct{}
+	mutex        sync.Mutex
+	logger       logr.Logger
 }
 
-func (s *State) AddAllocation(containerID string, allocation Allocation) {
+// Subscribe returns a channel that is notified whenever allocations or reservations change,
+// and a function that cancels the subscription.
+func (s *State) Subscribe() (<-chan struct{}, func()) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[chan struct{}]struct{})
+	}
+	ch := make(chan struct{}, 1)
+	s.subscribers[ch] = struct{}{}
+	return ch, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.subscribers, ch)
+	}
+}
 
-	s.Allocations[containerID] = allocation
-	cpus, _ := cpuset.Parse(allocation.CPUs)
-	for _, cpu := range cpus.List() {
-		cpuID, coreID, socketID, numaID := s.Topology.GetCPUParentInfo(cpu)
-		delete(s.AvailableResources[ResourceNameCPU], cpuID)
-		delete(s.AvailableResources[ResourceNameCore], coreID)
-		delete(s.AvailableResources[ResourceNameSocket], socketID)
-		delete(s.AvailableResources[ResourceNameNUMA], numaID)
+// notify notifies the subscribers without blocking. It must be called with the mutex held.
+func (s *State) notify() {
+	for ch := range s.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
 	}
+}
 
-	s.PrintAvailableResources()
+// SetReservedCPUs sets the CPUs that are served by the pools and excluded from the generic resources.
+func (s *State) SetReservedCPUs(cpus cpuset.CPUSet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ReservedCPUs = cpus.String()
 }
 
-func (s *State) RemoveAllocation(containerID string) {
+// GetReservedCPUs returns the CPUs that are served by the pools and excluded from the generic resources.
+func (s *State) GetReservedCPUs() cpuset.CPUSet {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	cpus, _ := cpuset.Parse(s.ReservedCPUs)
+	return cpus
+}
 
-	allocation, ok := s.Allocations[containerID]
-	if !ok {
-		return
+// Reserve atomically checks that the CPUs of the allocation are not held through a different allocation type,
+// and reserves them under key until the allocation is added for the container.
+// A reservation with the same key, e.g. from a repeated Allocate call for the same devices, is replaced.
+func (s *State) Reserve(key string, allocation Allocation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.checkConflicts(key, allocation); err != nil {
+		return err
+	}
+	s.Reservations[key] = Reservation{
+		Allocation: allocation,
+		CreatedAt:  time.Now(),
 	}
+	s.notify()
+	return nil
+}
 
-	s.Allocations[containerID] = allocation
+// AddAllocationIfFree atomically checks that the CPUs of the allocation are not held through a different allocation type,
+// and adds the allocation under key.
+func (s *State) AddAllocationIfFree(key string, allocation Allocation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	cpus, _ := cpuset.Parse(allocation.CPUs)
-	for _, cpu := range cpus.List() {
-		cpuID, coreID, socketID, numaID := s.Topology.GetCPUParentInfo(cpu)
-		s.AvailableResources[ResourceNameCPU][cpuID] = struct{}{}
-		s.AvailableResources[ResourceNameCore][coreID] = struct{}{}
-		s.AvailableResources[ResourceNameSocket][socketID] = struct{}{}
-		s.AvailableResources[ResourceNameNUMA][numaID] = struct{}{}
+	if err := s.checkConflicts(key, allocation); err != nil {
+		return err
 	}
+	s.addAllocation(key, allocation)
+	return nil
+}
+
+// checkConflicts returns a ConflictError if any CPU of the allocation is held, under another key,
+// through a different allocation type.
+func (s *State) checkConflicts(key string, allocation Allocation) error {
+	cpus, err := cpuset.Parse(allocation.CPUs)
+	if err != nil {
+		return err
+	}
+	for allocationKey, held := range s.Allocations {
+		if allocationKey == key {
+			continue
+		}
+		if conflict := conflictingCPUs(held, allocation, cpus); !conflict.IsEmpty() {
+			return &ConflictError{CPUs: conflict.String(), Holder: fmt.Sprintf("allocation %s", allocationKey)}
+		}
+	}
+	for reservationKey, held := range s.Reservations {
+		if reservationKey == key {
+			continue
+		}
+		if conflict := conflictingCPUs(held.Allocation, allocation, cpus); !conflict.IsEmpty() {
+			return &ConflictError{CPUs: conflict.String(), Holder: fmt.Sprintf("reservation %s", reservationKey)}
+		}
+	}
+	return nil
+}
 
-	delete(s.Allocations, containerID)
+// ReleaseReservation removes the reservation with the given key.
+func (s *State) ReleaseReservation(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.Reservations[key]; ok {
+		delete(s.Reservations, key)
+		s.notify()
+	}
+}
 
-	for _, allocation := range s.Allocations {
-		cpus, _ := cpuset.Parse(allocation.CPUs)
-		for _, cpu := range cpus.List() {
-			cpuID, coreID, socketID, numaID := s.Topology.GetCPUParentInfo(cpu)
-			delete(s.AvailableResources[ResourceNameCPU], cpuID)
-			delete(s.AvailableResources[ResourceNameCore], coreID)
-			delete(s.AvailableResources[ResourceNameSocket], socketID)
-			delete(s.AvailableResources[ResourceNameNUMA], numaID)
+// conflictingCPUs returns the CPUs of the requested allocation that are held through a different allocation type.
+func conflictingCPUs(held Allocation, requested Allocation, requestedCPUs cpuset.CPUSet) cpuset.CPUSet {
+	conflict := cpuset.New()
+	for heldType, heldCPUs := range held.cpusByType() {
+		if heldType == requested.Type {
+			continue
 		}
+		conflict = conflict.Union(heldCPUs.Intersection(requestedCPUs))
 	}
+	return conflict
+}
 
-	s.PrintAvailableResources()
+// AddAllocation adds the allocation under key, e.g. the ContainerKey of the container it is applied to.
+func (s *State) AddAllocation(key string, allocation Allocation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.addAllocation(key, allocation)
 }
 
-func (s *State) GetAllocations() map[string]Allocation {
+func (s *State) addAllocation(key string, allocation Allocation) {
+	s.Allocations[key] = allocation
+	for resourceName, deviceIDs := range allocation.Devices {
+		delete(s.Reservations, ReservationKey(resourceName, deviceIDs))
+	}
+	s.notify()
+	s.logger.V(1).Info("Allocation added", "key", key, "cpus", allocation.CPUs, "type", allocation.Type)
+}
+
+// RemoveAllocation removes the allocation stored under key.
+func (s *State) RemoveAllocation(key string) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	return s.Allocations
+
+	allocation, ok := s.Allocations[key]
+	if !ok {
+		return
+	}
+	delete(s.Allocations, key)
+	s.notify()
+	s.logger.V(1).Info("Allocation removed", "key", key, "cpus", allocation.CPUs, "type", allocation.Type)
+}
+
+// GetTopology returns the CPU topology of the node.
+func (s *State) GetTopology() *topology.Topology {
+	return s.Topology
 }
 
-func (s *State) GetAvailableResources() map[ResourceName]map[int]struct{} {
+// GetAllocation returns the allocation stored under key.
+func (s *State) GetAllocation(key string) (Allocation, bool) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	return s.AvailableResources
+	allocation, ok := s.Allocations[key]
+	return allocation, ok
 }
 
-func NewState() (*State, error) {
-	s := &State{}
+// GetAllocations returns a copy of the allocations, keyed like in the state.
+func (s *State) GetAllocations() map[string]Allocation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return maps.Clone(s.Allocations)
+}
 
-	t, err := topology.NewTopology()
-	if err != nil {
-		return nil, err
-	}
+// GetReservations returns a copy of the reservations, keyed by ReservationKey.
+func (s *State) GetReservations() map[string]Reservation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return maps.Clone(s.Reservations)
+}
 
-	availableResources := make(map[ResourceName]map[int]struct{})
-	availableResources[ResourceNameNUMA] = make(map[int]struct{})
-	availableResources[ResourceNameSocket] = make(map[int]struct{})
-	availableResources[ResourceNameCore] = make(map[int]struct{})
-	availableResources[ResourceNameCPU] = make(map[int]struct{})
+// IsUsedByOtherAllocationType reports whether any of the CPUs is allocated or reserved through an allocation of a different type.
+func (s *State) IsUsedByOtherAllocationType(cpus cpuset.CPUSet, allocationType AllocationType) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	for nodeID := range t.NUMATopology.Nodes {
-		availableResources[ResourceNameNUMA][nodeID] = struct{}{}
+	requested := Allocation{Type: allocationType}
+	for _, allocation := range s.Allocations {
+		if !conflictingCPUs(allocation, requested, cpus).IsEmpty() {
+			return true
+		}
 	}
-	for socketID := range t.CPUTopology.Sockets {
-		availableResources[ResourceNameSocket][socketID] = struct{}{}
-		for coreID := range t.CPUTopology.Sockets[socketID].Cores {
-			availableResources[ResourceNameCore][coreID] = struct{}{}
-			for _, cpu := range t.CPUTopology.Sockets[socketID].Cores[coreID].CPUs.List() {
-				availableResources[ResourceNameCPU][cpu] = struct{}{}
-			}
+	for _, reservation := range s.Reservations {
+		if !conflictingCPUs(reservation.Allocation, requested, cpus).IsEmpty() {
+			return true
 		}
 	}
+	return false
+}
 
-	s.Allocations = make(map[string]Allocation)
-	s.Topology = t
-	s.AvailableResources = availableResources
-
-	s.PrintAvailableResources()
-
-	return s, nil
+// NewState creates a new State of the CPU topology of the node, with no allocations.
+func NewState(logger logr.Logger) (*State, error) {
+	t, err := topology.NewTopology()
+	if err != nil {
+		return nil, err
+	}
+	return &State{
+		Allocations:  make(map[string]Allocation),
+		Reservations: make(map[string]Reservation),
+		Topology:     t,
+		logger:       logger.WithName("state"),
+	}, nil
 }
 
 func LoadFromFile(filename string) (*State, error) {
@@ -138,11 +253,3 @@ func (s *State) SaveToFile(filename string) error {
 	}
 	return os.WriteFile(filename, stateJSON, 0644)
 }
-
-func (s *State) PrintAvailableResources() {
-	fmt.Println("Available resources")
-	fmt.Printf("numa: %v\n", maps.Keys(s.AvailableResources[ResourceNameNUMA]))
-	fmt.Printf("socket: %v\n", maps.Keys(s.AvailableResources[ResourceNameSocket]))
-	fmt.Printf("core: %v\n", maps.Keys(s.AvailableResources[ResourceNameCore]))
-	fmt.Printf("cpu: %v\n", maps.Keys(s.AvailableResources[ResourceNameCPU]))
-}
@@ -0,0 +1,226 @@
+package plugin
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// RegistrationState represents the registration state of a device plugin with the kubelet.
+type RegistrationState string
+
+const (
+	RegistrationStatePending    RegistrationState = "Pending"
+	RegistrationStateRegistered RegistrationState = "Registered"
+	RegistrationStateFailed     RegistrationState = "Failed"
+)
+
+// PluginStatus describes the registration state of a device plugin.
+type PluginStatus struct {
+	State        RegistrationState `json:"state"`
+	LastError    string            `json:"lastError,omitempty"`
+	RegisteredAt *time.Time        `json:"registeredAt,omitempty"`
+}
+
+// restartTrigger is the reason a device plugin is restarted.
+type restartTrigger int
+
+const (
+	// triggerForce restarts the plugin unconditionally, e.g. when the kubelet has been restarted.
+	triggerForce restartTrigger = iota
+	// triggerSocketRemoved restarts the plugin only if its socket is still missing.
+	triggerSocketRemoved
+)
+
+// Supervisor keeps the device plugins registered with the kubelet.
+// It watches the device plugins directory and restarts each plugin independently, with backoff,
+// when the kubelet recreates its socket or when the socket of the plugin is deleted.
+type Supervisor struct {
+	plugins  []*CPUSetDevicePluginDriver
+	dir      string
+	triggers map[*CPUSetDevicePluginDriver]chan restartTrigger
+	statuses map[string]PluginStatus
+	backoff  wait.Backoff
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+	logger   logr.Logger
+}
+
+// NewSupervisor creates a new Supervisor for the device plugins serving in the devicePluginPath directory.
+func NewSupervisor(plugins []*CPUSetDevicePluginDriver, devicePluginPath string, logger logr.Logger) *Supervisor {
+	s := &Supervisor{
+		plugins:  plugins,
+		dir:      filepath.Clean(devicePluginPath),
+		triggers: make(map[*CPUSetDevicePluginDriver]chan restartTrigger),
+		statuses: make(map[string]PluginStatus),
+		backoff: wait.Backoff{
+			Duration: time.Second,
+			Factor:   2,
+			Jitter:   0.1,
+			Steps:    math.MaxInt32,
+			Cap:      time.Minute,
+		},
+		logger: logger.WithName("supervisor"),
+	}
+	for _, plugin := range plugins {
+		s.triggers[plugin] = make(chan restartTrigger, 1)
+		s.statuses[plugin.resourceName()] = PluginStatus{State: RegistrationStatePending}
+	}
+	return s
+}
+
+// Run starts and registers the device plugins, and keeps them registered until stopCh is closed.
+// The plugins are stopped before Run returns.
+func (s *Supervisor) Run(stopCh <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(s.dir); err != nil {
+		return err
+	}
+
+	for _, plugin := range s.plugins {
+		s.wg.Add(1)
+		go s.runPlugin(plugin, stopCh)
+		s.trigger(plugin, triggerForce)
+	}
+
+	for {
+		select {
+		case event := <-watcher.Events:
+			s.handleEvent(event)
+		case err := <-watcher.Errors:
+			s.logger.Error(err, "Device plugins directory watcher failed")
+		case <-stopCh:
+			s.wg.Wait()
+			return nil
+		}
+	}
+}
+
+// Statuses returns the registration status of every device plugin, keyed by resource name.
+func (s *Supervisor) Statuses() map[string]PluginStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	statuses := make(map[string]PluginStatus, len(s.statuses))
+	for name, status := range s.statuses {
+		statuses[name] = status
+	}
+	return statuses
+}
+
+// ServeHTTP writes the registration status of every device plugin as JSON.
+func (s *Supervisor) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Statuses()); err != nil {
+		s.logger.Error(err, "Failed to write registration statuses")
+	}
+}
+
+func (s *Supervisor) handleEvent(event fsnotify.Event) {
+	switch {
+	case event.Name == KubeletSocket(s.dir) && event.Has(fsnotify.Create):
+		s.logger.Info("Kubelet socket created, re-registering the device plugins")
+		for _, plugin := range s.plugins {
+			// The kubelet plugin watcher re-registers the plugins served in the plugins registry directory by itself.
+			if plugin.options.RegistrationMode == RegistrationModePluginWatcher {
+				continue
+			}
+			s.trigger(plugin, triggerForce)
+		}
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		for _, plugin := range s.plugins {
+			if event.Name == plugin.endpoint() {
+				s.trigger(plugin, triggerSocketRemoved)
+			}
+		}
+	}
+}
+
+// trigger requests a restart of the plugin. Pending requests are coalesced, keeping the forced ones.
+func (s *Supervisor) trigger(plugin *CPUSetDevicePluginDriver, trigger restartTrigger) {
+	ch := s.triggers[plugin]
+	for {
+		select {
+		case ch <- trigger:
+			return
+		case pending := <-ch:
+			if pending == triggerForce {
+				trigger = triggerForce
+			}
+		}
+	}
+}
+
+// runPlugin restarts the plugin whenever it is triggered, until stopCh is closed.
+func (s *Supervisor) runPlugin(plugin *CPUSetDevicePluginDriver, stopCh <-chan struct{}) {
+	defer s.wg.Done()
+	for {
+		select {
+		case trigger := <-s.triggers[plugin]:
+			if trigger == triggerSocketRemoved && s.isRegistered(plugin) && plugin.socketExists() {
+				// The socket was recreated by a restart of the plugin itself.
+				continue
+			}
+			s.restartPlugin(plugin, stopCh)
+		case <-stopCh:
+			if err := plugin.Stop(); err != nil {
+				s.logger.Error(err, "Failed to stop device plugin", "resource", plugin.resourceName())
+			}
+			return
+		}
+	}
+}
+
+// restartPlugin restarts and registers the plugin, retrying with backoff until it succeeds or stopCh is closed.
+func (s *Supervisor) restartPlugin(plugin *CPUSetDevicePluginDriver, stopCh <-chan struct{}) {
+	backoff := s.backoff
+	for {
+		err := plugin.Stop()
+		if err == nil {
+			err = plugin.Start()
+		}
+		if err == nil {
+			err = plugin.Register()
+		}
+		if err == nil {
+			now := time.Now()
+			s.setStatus(plugin, PluginStatus{State: RegistrationStateRegistered, RegisteredAt: &now})
+			return
+		}
+
+		delay := backoff.Step()
+		s.logger.Error(err, "Failed to register device plugin, retrying", "resource", plugin.resourceName(), "delay", delay)
+		s.setStatus(plugin, PluginStatus{State: RegistrationStateFailed, LastError: err.Error()})
+		select {
+		case <-time.After(delay):
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (s *Supervisor) isRegistered(plugin *CPUSetDevicePluginDriver) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.statuses[plugin.resourceName()].State == RegistrationStateRegistered
+}
+
+func (s *Supervisor) setStatus(plugin *CPUSetDevicePluginDriver, status PluginStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous := s.statuses[plugin.resourceName()]
+	if previous.State != status.State {
+		s.logger.Info("Device plugin registration state changed", "resource", plugin.resourceName(), "from", previous.State, "to", status.State)
+	}
+	s.statuses[plugin.resourceName()] = status
+}
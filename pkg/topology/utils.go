@@ -86,3 +86,13 @@ func (t *Topology) GetNUMANodesForCPUs(cpus []int) []int {
 	}
 	return maps.Keys(nodes)
 }
+
+func (t *Topology) GetAllCPUs() []int {
+	var cpus []int
+	for _, socket := range t.CPUTopology.Sockets {
+		for _, core := range socket.Cores {
+			cpus = append(cpus, core.CPUs.List()...)
+		}
+	}
+	return cpus
+}